@@ -0,0 +1,244 @@
+package acl
+
+import (
+	"errors"
+	"fmt"
+	"github.com/allape/dufs-broker/logging"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+var l = logging.New("acl")
+
+type Right uint8
+
+const (
+	Read Right = 1 << iota
+	Write
+	Delete
+	List
+
+	None Right = 0
+	All        = Read | Write | Delete | List
+)
+
+const Everyone = "*"
+
+var rightNames = map[string]Right{
+	"read":   Read,
+	"write":  Write,
+	"delete": Delete,
+	"list":   List,
+	"all":    All,
+	"none":   None,
+}
+
+func ParseRights(names []string) (Right, error) {
+	rights := None
+	for _, name := range names {
+		right, ok := rightNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return None, fmt.Errorf("unknown right %q", name)
+		}
+		rights |= right
+	}
+	return rights, nil
+}
+
+func (r Right) Has(right Right) bool {
+	return r&right == right
+}
+
+func (r Right) String() string {
+	if r == None {
+		return "none"
+	}
+	var names []string
+	for _, name := range []string{"read", "write", "delete", "list"} {
+		if r.Has(rightNames[name]) {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+type Checker interface {
+	// Rights of user on name
+	Rights(user, name string) Right
+	// TreeRights of user on name and on everything under it, which is what a recursive operation needs
+	TreeRights(user, name string) Right
+}
+
+type Rule struct {
+	User   string   `yaml:"user"`   // "*" for everyone
+	Path   string   `yaml:"path"`   // path prefix on dufs
+	Rights []string `yaml:"rights"` // read, write, delete, list, all or none
+}
+
+type rule struct {
+	user   string
+	path   string
+	rights Right
+}
+
+// ReadOnly allows everyone to read and list everything
+var ReadOnly = &Policy{
+	rules: []rule{
+		{
+			user:   Everyone,
+			path:   "/",
+			rights: Read | List,
+		},
+	},
+}
+
+type RulesFile struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Policy
+// The rule with the longest path prefix matching the path wins,
+// and a rule for the user wins over a rule for everyone with the same prefix.
+// Nothing is allowed when no rule matches.
+type Policy struct {
+	rules []rule
+}
+
+func NewPolicy(rules []Rule) (*Policy, error) {
+	policy := &Policy{}
+
+	var errs []error
+
+	for i, r := range rules {
+		if r.User == "" {
+			errs = append(errs, fmt.Errorf("rule #%d: user is required", i+1))
+			continue
+		}
+		rights, err := ParseRights(r.Rights)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule #%d: %w", i+1, err))
+			continue
+		}
+		policy.rules = append(policy.rules, rule{
+			user:   r.User,
+			path:   Clean(r.Path),
+			rights: rights,
+		})
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return policy, nil
+}
+
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules RulesFile
+	err = yaml.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	policy, err := NewPolicy(rules.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+
+	l.Info("Loaded rules", "count", len(policy.rules), "path", file)
+
+	return policy, nil
+}
+
+// Rights of user on name, everything is allowed by a nil policy
+func (p *Policy) Rights(user, name string) Right {
+	if p == nil {
+		return All
+	}
+
+	name = Clean(name)
+
+	var matched *rule
+	for i := range p.rules {
+		r := &p.rules[i]
+		if r.user != user && r.user != Everyone {
+			continue
+		}
+		if !HasPrefix(name, r.path) {
+			continue
+		}
+		if matched == nil ||
+			len(r.path) > len(matched.path) ||
+			(len(r.path) == len(matched.path) && matched.user == Everyone && r.user != Everyone) {
+			matched = r
+		}
+	}
+
+	if matched == nil {
+		return None
+	}
+
+	return matched.rights
+}
+
+// TreeRights of user on name, narrowed by every rule for user below name
+func (p *Policy) TreeRights(user, name string) Right {
+	rights := p.Rights(user, name)
+	if p == nil {
+		return rights
+	}
+
+	name = Clean(name)
+
+	for _, r := range p.rules {
+		if (r.user == user || r.user == Everyone) && r.path != name && HasPrefix(r.path, name) {
+			rights &= p.Rights(user, r.path)
+		}
+	}
+
+	return rights
+}
+
+// Reloadable is a Policy which can be replaced while in use
+type Reloadable struct {
+	policy atomic.Pointer[Policy]
+}
+
+func NewReloadable(policy *Policy) *Reloadable {
+	r := &Reloadable{}
+	r.Set(policy)
+	return r
+}
+
+func (r *Reloadable) Set(policy *Policy) {
+	r.policy.Store(policy)
+}
+
+func (r *Reloadable) Rights(user, name string) Right {
+	return r.policy.Load().Rights(user, name)
+}
+
+func (r *Reloadable) TreeRights(user, name string) Right {
+	return r.policy.Load().TreeRights(user, name)
+}
+
+// Clean returns the absolute, slash separated form of name
+func Clean(name string) string {
+	return path.Clean("/" + name)
+}
+
+// HasPrefix reports whether the cleaned name is prefix or inside it
+func HasPrefix(name, prefix string) bool {
+	if prefix == "/" || name == prefix {
+		return true
+	}
+	return strings.HasPrefix(name, prefix+"/")
+}
@@ -0,0 +1,66 @@
+package acl
+
+import "testing"
+
+type RightsTestCase struct {
+	User   string
+	Path   string
+	Rights Right
+}
+
+func TestPolicy(t *testing.T) {
+	policy, err := NewPolicy([]Rule{
+		{User: Everyone, Path: "/", Rights: []string{"list"}},
+		{User: Everyone, Path: "/pub", Rights: []string{"read", "list"}},
+		{User: "alice", Path: "/pub", Rights: []string{"all"}},
+		{User: "bob", Path: "/pub/private", Rights: []string{"none"}},
+		{User: "bob", Path: "/bob/", Rights: []string{"read", "write", "list"}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	cases := []RightsTestCase{
+		{"carol", "/", List},
+		{"carol", "/public", List},
+		{"carol", "/pub", Read | List},
+		{"carol", "/pub/a/../b", Read | List},
+		{"alice", "/pub/private/x", All},
+		{"bob", "/pub/private/x", None},
+		{"bob", "/pub/privateer", Read | List},
+		{"bob", "bob/x", Read | Write | List},
+		{"carol", "/bob/x", List},
+	}
+
+	for _, c := range cases {
+		if rights := policy.Rights(c.User, c.Path); rights != c.Rights {
+			t.Errorf("Expected %s for %s on %s but got %s", c.Rights, c.User, c.Path, rights)
+		}
+	}
+
+	treeCases := []RightsTestCase{
+		{"carol", "/pub", Read | List},
+		{"bob", "/pub", None},
+		{"bob", "/pub/privateer", Read | List},
+		{"alice", "/pub", All},
+		{"alice", "/", List},
+	}
+
+	for _, c := range treeCases {
+		if rights := policy.TreeRights(c.User, c.Path); rights != c.Rights {
+			t.Errorf("Expected %s for the tree of %s on %s but got %s", c.Rights, c.User, c.Path, rights)
+		}
+	}
+
+	if rights := (*Policy)(nil).Rights("anyone", "/"); rights != All {
+		t.Errorf("Expected all for a nil policy but got %s", rights)
+	}
+
+	_, err = NewPolicy([]Rule{
+		{User: "", Path: "/", Rights: []string{"read"}},
+		{User: "alice", Path: "/", Rights: []string{"execute"}},
+	})
+	if err == nil {
+		t.Errorf("Expected error but got nil")
+	}
+}
@@ -0,0 +1,176 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/allape/dufs-broker/logging"
+	"github.com/allape/dufs-broker/session"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var l = logging.New("admin")
+
+// DefaultBan is how long an IP is banned for if no duration is given
+const DefaultBan = time.Hour
+
+// Server is the admin API, every request needs the token in an "Authorization: Bearer" header
+//
+//	GET    /sessions       sessions of every protocol, with their transfers in flight
+//	DELETE /sessions/{id}  disconnect a session
+//	GET    /bans           IPs banned for now
+//	PUT    /bans/{ip}      ban an IP for ?duration=1h and disconnect its sessions
+//	DELETE /bans/{ip}      lift the ban of an IP
+//	GET    /config         effective configuration, without secrets
+type Server struct {
+	server *http.Server
+	token  atomic.Pointer[string]
+	config func() any
+}
+
+// Start serves the admin API on addr, config returns what GET /config shows
+func Start(addr, token string, config func() any) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		config: config,
+	}
+	s.SetToken(token)
+
+	s.server = &http.Server{
+		Handler:           s.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	l.Info("Admin API served", "url", "http://"+listener.Addr().String())
+
+	go func() {
+		err := s.server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			l.Error("Failed to serve admin API", "error", err)
+		}
+	}()
+
+	return s, nil
+}
+
+// SetToken replaces the token, for reloads
+func (s *Server) SetToken(token string) {
+	s.token.Store(&token)
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+// handler routes the requests of the API, once authorized
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", s.sessions)
+	mux.HandleFunc("DELETE /sessions/{id}", s.kick)
+	mux.HandleFunc("GET /bans", s.bans)
+	mux.HandleFunc("PUT /bans/{ip}", s.ban)
+	mux.HandleFunc("DELETE /bans/{ip}", s.unban)
+	mux.HandleFunc("GET /config", s.effectiveConfig)
+
+	return s.authorize(mux)
+}
+
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := *s.token.Load()
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			l.Warn("Unauthorized request", "remote_addr", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) sessions(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, session.Sessions())
+}
+
+func (s *Server) kick(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid session id")
+		return
+	}
+
+	if !session.Kick(id) {
+		writeError(w, http.StatusNotFound, "no such session")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) bans(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, session.Bans())
+}
+
+func (s *Server) ban(w http.ResponseWriter, r *http.Request) {
+	duration := DefaultBan
+	if d := r.URL.Query().Get("duration"); d != "" {
+		var err error
+		duration, err = time.ParseDuration(d)
+		if err != nil || duration <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid duration, such as 30m or 24h")
+			return
+		}
+	}
+
+	until, kicked, err := session.Ban(r.PathValue("ip"), duration)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"until":  until,
+		"kicked": kicked,
+	})
+}
+
+func (s *Server) unban(w http.ResponseWriter, r *http.Request) {
+	if !session.Unban(r.PathValue("ip")) {
+		writeError(w, http.StatusNotFound, "not banned")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) effectiveConfig(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.config())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	err := encoder.Encode(v)
+	if err != nil {
+		l.Debug("Failed to write response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{
+		"error": message,
+	})
+}
@@ -0,0 +1,165 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/allape/dufs-broker/logging"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var l = logging.New("audit")
+
+const (
+	OpRead   = "read"   // a file opened and read
+	OpUpload = "upload" // a file opened and written
+	OpOpen   = "open"   // a file which failed to open, so it is unknown whether to read or to write
+	OpMkdir  = "mkdir"
+	OpRename = "rename"
+	OpRemove = "remove"
+	OpLogin  = "login" // only failed logins are recorded
+)
+
+const (
+	ResultOK      = "ok"
+	ResultFailure = "failure"
+)
+
+// Record is a line of the audit log
+type Record struct {
+	Time     time.Time `json:"time"`
+	Protocol string    `json:"protocol"`
+	User     string    `json:"user"`
+	RemoteIP string    `json:"remote_ip"` // empty for NFS, whose files are shared by every connection
+	Op       string    `json:"op"`
+	Path     string    `json:"path"`
+	NewPath  string    `json:"new_path,omitempty"` // of rename
+	Bytes    int64     `json:"bytes"`
+	Result   string    `json:"result"`
+	Error    string    `json:"error,omitempty"`
+}
+
+var (
+	locker sync.Mutex
+	output io.WriteCloser // records are dropped if nil
+)
+
+// Start writes the records to path, or to stdout if path is "-".
+// The file is rotated once it grows beyond maxSize bytes, keeping backups of the previous ones.
+func Start(path string, maxSize int64, backups int) error {
+	var w io.WriteCloser = nopCloser{os.Stdout}
+	if path != "-" {
+		file, err := openRotating(path, maxSize, backups)
+		if err != nil {
+			return err
+		}
+		w = file
+	}
+
+	locker.Lock()
+	defer locker.Unlock()
+
+	if output != nil {
+		_ = output.Close()
+	}
+	output = w
+
+	return nil
+}
+
+// Stop logs the reads still being gathered and closes the audit log, records are dropped after it
+func Stop() error {
+	flushGathered()
+
+	locker.Lock()
+	defer locker.Unlock()
+
+	if output == nil {
+		return nil
+	}
+
+	err := output.Close()
+	output = nil
+	return err
+}
+
+// Log writes r as a line, Time and Result are filled in if empty
+func Log(r Record) {
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	if r.Result == "" {
+		r.Result = ResultOK
+		if r.Error != "" {
+			r.Result = ResultFailure
+		}
+	}
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		l.Error("Failed to encode record", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	locker.Lock()
+	defer locker.Unlock()
+
+	if output == nil {
+		return
+	}
+
+	_, err = output.Write(line)
+	if err != nil {
+		l.Error("Failed to write record", "error", err)
+	}
+}
+
+// LoginFailed records a rejected login of user from addr
+func LoginFailed(protocol, user string, addr net.Addr, err error) {
+	Log(Record{
+		Protocol: protocol,
+		User:     user,
+		RemoteIP: IP(addr),
+		Op:       OpLogin,
+		Error:    message(err),
+	})
+}
+
+// IP is the host of addr, without the port
+func IP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func message(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// isEOF reports whether err only marks the end of a read, which is not a failure
+func isEOF(err error) bool {
+	return err == nil || errors.Is(err, io.EOF)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,156 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"github.com/allape/dufs-broker/vfs"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type memFile struct {
+	vfs.File
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	return copy(p, "abc"), io.EOF
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+type memFS struct {
+	vfs.FS
+}
+
+func (m *memFS) Open(_ string) (vfs.File, error) {
+	return &memFile{}, nil
+}
+
+func (m *memFS) Remove(_ string) error {
+	return fs.ErrPermission
+}
+
+func (m *memFS) Rename(_, _ string) error {
+	return nil
+}
+
+func TestWrap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	err := Start(path, 0, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	fsys := Wrap(&memFS{}, "test", "alice", "/home/alice", "127.0.0.1")
+
+	file, _ := fsys.Open("/a")
+	_, _ = file.Write([]byte("hello"))
+	_ = file.Close()
+
+	file, _ = fsys.Open("/dir")
+	_ = file.Close()
+
+	_ = fsys.Rename("/a", "/b")
+	_ = fsys.Remove("/b")
+	LoginFailed("test", "mallory", nil, errors.New("invalid password"))
+
+	// the reads of a shared file are gathered until it is idle, or the log is stopped
+	shared := WrapShared(&memFS{}, "test", "bob", "/", time.Hour)
+	for i := 0; i < 3; i++ {
+		file, _ = shared.Open("/c")
+		_, _ = file.Read(make([]byte, 8))
+		_ = file.Close()
+	}
+
+	err = Stop()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []Record{
+		{Op: OpUpload, Path: "/home/alice/a", Bytes: 5, Result: ResultOK},
+		{Op: OpRename, Path: "/home/alice/a", NewPath: "/home/alice/b", Result: ResultOK},
+		{Op: OpRemove, Path: "/home/alice/b", Result: ResultFailure},
+		{Op: OpLogin, User: "mallory", Result: ResultFailure},
+		{Op: OpRead, User: "bob", Path: "/c", Bytes: 9, Result: ResultOK},
+	}
+
+	log, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer func() {
+		_ = log.Close()
+	}()
+
+	var records []Record
+	scanner := bufio.NewScanner(log)
+	for scanner.Scan() {
+		var record Record
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		records = append(records, record)
+	}
+
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d records but got %d: %+v", len(expected), len(records), records)
+	}
+
+	for i, e := range expected {
+		r := records[i]
+		if r.Op != e.Op || r.Path != e.Path || r.NewPath != e.NewPath || r.Bytes != e.Bytes || r.Result != e.Result {
+			t.Errorf("Expected %+v but got %+v", e, r)
+		}
+		if e.User == "" && (r.User != "alice" || r.RemoteIP != "127.0.0.1" || r.Protocol != "test") {
+			t.Errorf("Expected alice from 127.0.0.1 over test but got %+v", r)
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	r, err := openRotating(path, 10, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, line := range []string{"1111111\n", "2222222\n", "3333333\n", "4444444\n"} {
+		_, err = r.Write([]byte(line))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	_ = r.Close()
+
+	cases := []struct {
+		path    string
+		content string
+	}{
+		{path, "4444444\n"},
+		{path + ".1", "3333333\n"},
+		{path + ".2", "2222222\n"},
+		{path + ".3", ""},
+	}
+
+	for _, c := range cases {
+		content, _ := os.ReadFile(c.path)
+		if string(content) != c.content {
+			t.Errorf("Expected %q in %s but got %q", c.content, c.path, content)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package audit
+
+import (
+	"sync"
+	"time"
+)
+
+// gathered are the reads recorded by WrapShared which are not logged yet, by user and path
+var gathered = struct {
+	locker  sync.Mutex
+	pending map[gatherKey]*pendingRead
+}{
+	pending: map[gatherKey]*pendingRead{},
+}
+
+type gatherKey struct {
+	protocol string
+	user     string
+	path     string
+}
+
+type pendingRead struct {
+	record Record
+	timer  *time.Timer
+}
+
+// gather adds the read r to the pending record of its file, which is logged once it is not read for idle
+func gather(r Record, idle time.Duration) {
+	gathered.locker.Lock()
+	defer gathered.locker.Unlock()
+
+	r.Time = time.Now()
+	key := gatherKey{r.Protocol, r.User, r.Path}
+
+	pending, ok := gathered.pending[key]
+	if !ok {
+		pending = &pendingRead{
+			record: r,
+		}
+		gathered.pending[key] = pending
+		pending.timer = time.AfterFunc(idle, func() {
+			gathered.locker.Lock()
+			due := gathered.pending[key] == pending
+			if due {
+				delete(gathered.pending, key)
+			}
+			gathered.locker.Unlock()
+
+			if due {
+				Log(pending.record)
+			}
+		})
+		return
+	}
+
+	pending.timer.Reset(idle)
+	pending.record.Time = r.Time
+	pending.record.Bytes += r.Bytes
+	if pending.record.Error == "" {
+		pending.record.Error = r.Error
+	}
+}
+
+// flushGathered logs every pending read at once
+func flushGathered() {
+	gathered.locker.Lock()
+	var records []Record
+	for key, pending := range gathered.pending {
+		pending.timer.Stop()
+		records = append(records, pending.record)
+		delete(gathered.pending, key)
+	}
+	gathered.locker.Unlock()
+
+	for _, r := range records {
+		Log(r)
+	}
+}
@@ -0,0 +1,103 @@
+package audit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// rotating is a file renamed to path.1 once it grows beyond maxSize,
+// path.1 is renamed to path.2 and so on, up to backups files
+type rotating struct {
+	path    string
+	maxSize int64
+	backups int
+
+	file *os.File
+	size int64
+}
+
+func openRotating(path string, maxSize int64, backups int) (*rotating, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &rotating{
+		path:    path,
+		maxSize: maxSize,
+		backups: backups,
+	}
+
+	err = r.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *rotating) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	r.file = file
+	r.size = stat.Size()
+
+	return nil
+}
+
+// Write is called with the lock of the audit log held, so a line is never split across files
+func (r *rotating) Write(p []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotating) rotate() error {
+	err := r.file.Close()
+	if err != nil {
+		return err
+	}
+
+	if r.backups > 0 {
+		_ = os.Remove(r.backup(r.backups))
+		for i := r.backups - 1; i > 0; i-- {
+			err = os.Rename(r.backup(i), r.backup(i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		err = os.Rename(r.path, r.backup(1))
+	} else {
+		err = os.Remove(r.path)
+	}
+	if err != nil {
+		return err
+	}
+
+	return r.open()
+}
+
+func (r *rotating) backup(i int) string {
+	return fmt.Sprintf("%s.%d", r.path, i)
+}
+
+func (r *rotating) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,190 @@
+package audit
+
+import (
+	"github.com/allape/dufs-broker/vfs"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// Wrap records every file transfer, mkdir, rename and remove on fsys,
+// a transfer is recorded when its file is closed.
+// fsys is jailed into home, which the recorded paths start with, so they are the paths on dufs.
+func Wrap(fsys vfs.FS, protocol, user, home, remoteIP string) vfs.FS {
+	return &auditedFS{
+		FS:       fsys,
+		protocol: protocol,
+		user:     user,
+		home:     home,
+		remoteIP: remoteIP,
+	}
+}
+
+// WrapShared is Wrap for files shared by every connection, such as over NFS, so records have no remote IP.
+// The reads of a file are a single record until it is not read for idle,
+// as NFS opens the file for every READ.
+func WrapShared(fsys vfs.FS, protocol, user, home string, idle time.Duration) vfs.FS {
+	return &auditedFS{
+		FS:       fsys,
+		protocol: protocol,
+		user:     user,
+		home:     home,
+		readIdle: idle,
+	}
+}
+
+type auditedFS struct {
+	vfs.FS
+	protocol string
+	user     string
+	home     string
+	remoteIP string
+	readIdle time.Duration // the reads of a file are gathered for, each close is a record if 0
+}
+
+func (a *auditedFS) record(op, name, newName string, bytes int64, err error) Record {
+	r := Record{
+		Protocol: a.protocol,
+		User:     a.user,
+		RemoteIP: a.remoteIP,
+		Op:       op,
+		Path:     a.path(name),
+		Bytes:    bytes,
+		Error:    message(err),
+	}
+	if newName != "" {
+		r.NewPath = a.path(newName)
+	}
+	return r
+}
+
+func (a *auditedFS) log(op, name, newName string, bytes int64, err error) {
+	Log(a.record(op, name, newName, bytes, err))
+}
+
+// path of name on dufs
+func (a *auditedFS) path(name string) string {
+	p, err := vfs.JailPath(a.home, name)
+	if err != nil {
+		return name // fsys rejects it anyway
+	}
+	return p
+}
+
+func (a *auditedFS) Open(name string) (vfs.File, error) {
+	file, err := a.FS.Open(name)
+	if err != nil {
+		a.log(OpOpen, name, "", 0, err)
+		return nil, err
+	}
+	return &auditedFile{
+		File: file,
+		fs:   a,
+		path: name,
+	}, nil
+}
+
+func (a *auditedFS) Mkdir(name string, perm fs.FileMode) error {
+	err := a.FS.Mkdir(name, perm)
+	a.log(OpMkdir, name, "", 0, err)
+	return err
+}
+
+func (a *auditedFS) Remove(name string) error {
+	err := a.FS.Remove(name)
+	a.log(OpRemove, name, "", 0, err)
+	return err
+}
+
+func (a *auditedFS) Rename(oldname, newname string) error {
+	err := a.FS.Rename(oldname, newname)
+	a.log(OpRename, oldname, newname, 0, err)
+	return err
+}
+
+// auditedFile is recorded as an upload once written to, as a read once read from,
+// and not at all if neither, such as a directory being listed
+type auditedFile struct {
+	vfs.File
+	fs   *auditedFS
+	path string
+
+	locker sync.Mutex
+	op     string
+	bytes  int64
+	err    error // the first one
+}
+
+func (a *auditedFile) record(op string, n int64, err error) {
+	a.locker.Lock()
+	defer a.locker.Unlock()
+
+	if op == OpUpload || a.op == "" {
+		a.op = op
+	}
+	a.bytes += n
+	if a.err == nil && !isEOF(err) {
+		a.err = err
+	}
+}
+
+func (a *auditedFile) Read(p []byte) (int, error) {
+	n, err := a.File.Read(p)
+	a.record(OpRead, int64(n), err)
+	return n, err
+}
+
+func (a *auditedFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := a.File.ReadAt(p, off)
+	a.record(OpRead, int64(n), err)
+	return n, err
+}
+
+func (a *auditedFile) Write(p []byte) (int, error) {
+	n, err := a.File.Write(p)
+	a.record(OpUpload, int64(n), err)
+	return n, err
+}
+
+func (a *auditedFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := a.File.WriteAt(p, off)
+	a.record(OpUpload, int64(n), err)
+	return n, err
+}
+
+func (a *auditedFile) ReadFrom(r io.Reader) (int64, error) {
+	n, err := a.File.ReadFrom(r)
+	a.record(OpUpload, n, err)
+	return n, err
+}
+
+func (a *auditedFile) ReadFromAt(r io.Reader, off int64) (int64, error) {
+	n, err := a.File.ReadFromAt(r, off)
+	a.record(OpUpload, n, err)
+	return n, err
+}
+
+func (a *auditedFile) Close() error {
+	err := a.File.Close()
+
+	a.locker.Lock()
+	op, bytes, first := a.op, a.bytes, a.err
+	a.locker.Unlock()
+
+	if op == "" {
+		return err
+	}
+	if first == nil {
+		first = err
+	}
+
+	if op == OpRead && a.fs.readIdle > 0 {
+		gather(a.fs.record(op, a.path, "", bytes, first), a.fs.readIdle)
+		return err
+	}
+
+	a.fs.log(op, a.path, "", bytes, first)
+
+	return err
+}
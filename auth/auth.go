@@ -0,0 +1,278 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/allape/dufs-broker/acl"
+	"github.com/allape/dufs-broker/logging"
+	"github.com/allape/dufs-broker/upstream"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+var l = logging.New("auth")
+
+var (
+	ErrInvalidCredentials = errors.New("invalid user or password")
+	ErrUnknownUser        = errors.New("unknown user")
+)
+
+// dummyHash is compared against when the user does not exist, so both cases take the same time
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dufs-broker"), bcrypt.DefaultCost)
+
+type Upstream struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+func (u *Upstream) userinfo() *url.Userinfo {
+	return url.UserPassword(u.Username, u.Password)
+}
+
+type User struct {
+	Name      string               `yaml:"name"`
+	Password  string               `yaml:"password"`  // bcrypt hash
+	Upstream  *Upstream            `yaml:"upstream"`  // credentials sent to dufs, nil to use the ones in the dufs server URL
+	Upstreams map[string]*Upstream `yaml:"upstreams"` // credentials sent to the dufs server mounted at each path, instead of Upstream
+	Home      string               `yaml:"home"`      // path on dufs this user is jailed into, the root if empty
+	Anonymous bool                 `yaml:"-"`
+}
+
+// Userinfo is the credentials of this user for the dufs server mounted at mount,
+// nil to use the ones in the URL of that server
+func (u *User) Userinfo(mount string) *url.Userinfo {
+	if u == nil {
+		return nil
+	}
+	creds := u.Upstream
+	if c, ok := u.Upstreams[acl.Clean(mount)]; ok {
+		creds = c
+	}
+	if creds == nil {
+		return nil
+	}
+	return creds.userinfo()
+}
+
+type Authenticator interface {
+	// Authenticate checks the password of a user
+	Authenticate(name, password string) (*User, error)
+	// Lookup finds a user who is already authenticated by other means, such as an SSH public key
+	Lookup(name string) (*User, error)
+}
+
+// Reloadable is an Authenticator which can be replaced while in use
+type Reloadable struct {
+	authenticator atomic.Pointer[Authenticator]
+}
+
+func NewReloadable(authenticator Authenticator) *Reloadable {
+	r := &Reloadable{}
+	r.Set(authenticator)
+	return r
+}
+
+func (r *Reloadable) Set(authenticator Authenticator) {
+	r.authenticator.Store(&authenticator)
+}
+
+func (r *Reloadable) Authenticate(name, password string) (*User, error) {
+	return (*r.authenticator.Load()).Authenticate(name, password)
+}
+
+func (r *Reloadable) Lookup(name string) (*User, error) {
+	return (*r.authenticator.Load()).Lookup(name)
+}
+
+type UsersFile struct {
+	Users []*User `yaml:"users"`
+}
+
+type Store struct {
+	users map[string]*User
+}
+
+func NewStore(users []*User) (*Store, error) {
+	store := &Store{
+		users: make(map[string]*User, len(users)),
+	}
+
+	var errs []error
+
+	for i, user := range users {
+		if user.Name == "" {
+			errs = append(errs, fmt.Errorf("user #%d: name is required", i+1))
+			continue
+		}
+		if _, ok := store.users[user.Name]; ok {
+			errs = append(errs, fmt.Errorf("user %q: duplicated", user.Name))
+			continue
+		}
+		if _, err := bcrypt.Cost([]byte(user.Password)); err != nil {
+			errs = append(errs, fmt.Errorf("user %q: password is not a bcrypt hash: %w", user.Name, err))
+			continue
+		}
+		upstreams := make(map[string]*Upstream, len(user.Upstreams))
+		for mount, creds := range user.Upstreams {
+			upstreams[acl.Clean(mount)] = creds
+		}
+		user.Upstreams = upstreams
+		store.users[user.Name] = user
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return store, nil
+}
+
+func LoadStore(path string) (*Store, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file UsersFile
+	err = yaml.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	store, err := NewStore(file.Users)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	l.Info("Loaded users", "count", len(store.users), "path", path)
+
+	return store, nil
+}
+
+func (s *Store) Authenticate(name, password string) (*User, error) {
+	user, ok := s.users[name]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	return user, nil
+}
+
+func (s *Store) Lookup(name string) (*User, error) {
+	user, ok := s.users[name]
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+	return user, nil
+}
+
+// SingleUser is the legacy mode: the only user is the one in the dufs server URL
+type SingleUser struct {
+	Userinfo *url.Userinfo
+	// Open lets everyone in when the URL has no user
+	Open bool
+}
+
+func (s *SingleUser) Authenticate(name, password string) (*User, error) {
+	if s.Userinfo.Username() == "" && s.Open {
+		return &User{
+			Name: name,
+		}, nil
+	}
+
+	if name == s.Userinfo.Username() {
+		if expected, ok := s.Userinfo.Password(); ok && password == expected {
+			return &User{
+				Name: name,
+			}, nil
+		}
+	}
+
+	return nil, ErrInvalidCredentials
+}
+
+func (s *SingleUser) Lookup(name string) (*User, error) {
+	return &User{
+		Name: name,
+	}, nil
+}
+
+// Passthrough lets dufs decide: the credentials are forwarded to every dufs server mounted,
+// and accepted if none of them rejects them. A server which does not answer is skipped, unless none does.
+type Passthrough struct {
+	Factories []*upstream.Factory
+	Users     *Store // optional, for users authenticated by other means
+}
+
+func (p *Passthrough) Authenticate(name, password string) (*User, error) {
+	user := &User{
+		Name: name,
+		Upstream: &Upstream{
+			Username: name,
+			Password: password,
+		},
+	}
+
+	var unreachable error
+	verified := false
+	for _, factory := range p.Factories {
+		err := factory.Verify(user.Upstream.userinfo())
+		if errors.Is(err, upstream.ErrUnauthorized) {
+			return nil, ErrInvalidCredentials
+		} else if err != nil {
+			unreachable = err
+			continue
+		}
+		verified = true
+	}
+
+	if !verified {
+		return nil, unreachable
+	}
+
+	return user, nil
+}
+
+func (p *Passthrough) Lookup(name string) (*User, error) {
+	if p.Users != nil {
+		return p.Users.Lookup(name)
+	}
+	return &User{
+		Name: name,
+	}, nil
+}
+
+const AnonymousUser = "anonymous"
+
+// IsAnonymous reports whether name is one of the conventional anonymous FTP users
+func IsAnonymous(name string) bool {
+	name = strings.ToLower(name)
+	return name == AnonymousUser || name == "ftp"
+}
+
+// Anonymous lets anonymous users in with any password, and leaves everyone else to Authenticator
+type Anonymous struct {
+	Authenticator
+	Home string
+}
+
+func (a *Anonymous) Authenticate(name, password string) (*User, error) {
+	if IsAnonymous(name) {
+		return &User{
+			Name:      AnonymousUser,
+			Home:      a.Home,
+			Anonymous: true,
+		}, nil
+	}
+	return a.Authenticator.Authenticate(name, password)
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"testing"
+)
+
+func hash(t *testing.T, password string) string {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(h)
+}
+
+func TestStore(t *testing.T) {
+	store, err := NewStore([]*User{
+		{Name: "alice", Password: hash(t, "alice"), Upstream: &Upstream{Username: "a", Password: "b"}, Upstreams: map[string]*Upstream{
+			"media/": {Username: "m", Password: "c"},
+		}},
+		{Name: "bob", Password: hash(t, "bob")},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	user, err := store.Authenticate("alice", "alice")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if user.Userinfo("/").String() != "a:b" {
+		t.Errorf("Expected upstream a:b but got %s", user.Userinfo("/"))
+	}
+	if user.Userinfo("/media").String() != "m:c" {
+		t.Errorf("Expected upstream m:c for /media but got %s", user.Userinfo("/media"))
+	}
+
+	user, err = store.Authenticate("bob", "bob")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if user.Userinfo("/media") != nil {
+		t.Errorf("Expected no upstream credentials but got %s", user.Userinfo("/media"))
+	}
+
+	if _, err = store.Authenticate("bob", "alice"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Expected ErrInvalidCredentials but got %v", err)
+	}
+
+	if _, err = store.Authenticate("carol", "carol"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Expected ErrInvalidCredentials but got %v", err)
+	}
+
+	if _, err = store.Lookup("carol"); !errors.Is(err, ErrUnknownUser) {
+		t.Errorf("Expected ErrUnknownUser but got %v", err)
+	}
+
+	_, err = NewStore([]*User{
+		{Name: "", Password: hash(t, "x")},
+		{Name: "alice", Password: "plain"},
+		{Name: "bob", Password: hash(t, "bob")},
+		{Name: "bob", Password: hash(t, "bob")},
+	})
+	if err == nil {
+		t.Errorf("Expected error but got nil")
+	}
+}
+
+func TestAnonymous(t *testing.T) {
+	authenticator := &Anonymous{
+		Authenticator: &SingleUser{},
+	}
+
+	for _, name := range []string{"anonymous", "FTP"} {
+		user, err := authenticator.Authenticate(name, "guest@example.com")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !user.Anonymous || user.Name != AnonymousUser {
+			t.Errorf("Expected %s to be anonymous", name)
+		}
+	}
+
+	if _, err := authenticator.Authenticate("alice", "alice"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Expected ErrInvalidCredentials but got %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/allape/dufs-broker/env"
+	"github.com/allape/dufs-broker/ftp"
+	"github.com/allape/dufs-broker/sftp"
+	"github.com/allape/dufs-broker/upstream"
+	"os"
+)
+
+// check verifies what serve would need, and reports every failure instead of stopping at the first one
+func check(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	env.RegisterFlags(flags)
+	_ = flags.Parse(args)
+
+	if flags.NArg() > 0 {
+		_ = os.Setenv(env.DubrokerDufsServer, flags.Arg(0))
+	}
+
+	failed := 0
+	report := func(name string, err error) {
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL  %s\n%v\n", name, err)
+		} else {
+			fmt.Printf("ok    %s\n", name)
+		}
+	}
+
+	file, err := loadConfig()
+	report("configuration", err)
+
+	mounts, err := loadMounts(file)
+	report("dufs servers, mounts and trusted certs", err)
+
+	for _, m := range mounts {
+		report("dufs server "+env.Redact(m.upstream.URL)+" at "+m.upstream.Mount, checkUpstream(m.factory))
+		if len(m.upstream.Replicas) > 0 {
+			report("dufs replicas at "+m.upstream.Mount, m.pool.Check(context.Background()))
+		}
+	}
+
+	if len(mounts) > 0 {
+		_, _, err = loadAuthenticator(mounts, file)
+		report("users", err)
+	}
+
+	_, err = loadPolicy(file)
+	report("ACL", err)
+
+	if env.FTPEnabled && ftp.TLSEnabled() {
+		report("FTP TLS certificate", ftp.LoadCertificate())
+	}
+
+	if env.SFTPEnabled {
+		if env.SFTPAuthorizedKeys != "" {
+			_, err = sftp.NewAuthorizedKeys(env.SFTPAuthorizedKeys)
+			report("SFTP authorized keys", err)
+		}
+		if env.SFTPHostKeys != "" {
+			_, err = sftp.LoadHostKeys(env.SFTPHostKeys, env.StateDir)
+			report("SFTP host keys", err)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+
+	return nil
+}
+
+// checkUpstream sends a request to dufs with the credentials in its URL, which needs no credentials if they have none
+func checkUpstream(factory *upstream.Factory) error {
+	root := factory.Root()
+
+	err := factory.Verify(root.User)
+	if errors.Is(err, upstream.ErrUnauthorized) && root.User == nil {
+		fmt.Println("      dufs requires credentials, users need their own")
+		return nil
+	}
+
+	return err
+}
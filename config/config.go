@@ -0,0 +1,252 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/allape/dufs-broker/acl"
+	"github.com/allape/dufs-broker/auth"
+	"github.com/allape/dufs-broker/env"
+	"github.com/allape/dufs-broker/logging"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var l = logging.New("config")
+
+// File is the config file given by --config.
+// Scalars are kept as strings so unset ones can be told apart, environment variables win over them.
+type File struct {
+	LogLevel  string       `yaml:"log_level"`
+	LogFormat string       `yaml:"log_format"`
+	StateDir  string       `yaml:"state_dir"`
+	Upstreams []Upstream   `yaml:"upstreams"`
+	Listeners Listeners    `yaml:"listeners"`
+	Auth      Auth         `yaml:"auth"`
+	Users     []*auth.User `yaml:"users"` // instead of auth.users_file
+	Rules     []acl.Rule   `yaml:"rules"` // instead of auth.acl_file
+	Anonymous Anonymous    `yaml:"anonymous"`
+	TLS       TLS          `yaml:"tls"`
+	Limits    Limits       `yaml:"limits"`
+	Audit     Audit        `yaml:"audit"`
+}
+
+type Upstream struct {
+	Name         string   `yaml:"name"`
+	URL          string   `yaml:"url"`           // credentials in it are used by users without their own
+	Mount        string   `yaml:"mount"`         // top-level directory this dufs server is shown at, such as /media
+	TrustedCerts []string `yaml:"trusted_certs"` // CAs trusted for this dufs server, in addition to tls.trusted_certs
+	Replicas     []string `yaml:"replicas"`      // dufs servers sharing the same files, requests keep the credentials in url
+	PinWrites    bool     `yaml:"pin_writes"`    // send writes to url only, instead of any replica online
+}
+
+// Mounted reports whether the upstreams are mounted under top-level directories,
+// instead of the only one at the root, which may be given by DUBROKER_DUFS_SERVER
+func (f *File) Mounted() bool {
+	if f == nil {
+		return false
+	}
+	for _, upstream := range f.Upstreams {
+		if upstream.Mount != "" {
+			return true
+		}
+	}
+	return false
+}
+
+type Listeners struct {
+	FTP     FTPListener     `yaml:"ftp"`
+	SFTP    SFTPListener    `yaml:"sftp"`
+	NFS     NFSListener     `yaml:"nfs"`
+	Metrics MetricsListener `yaml:"metrics"`
+	Admin   AdminListener   `yaml:"admin"`
+}
+
+type FTPListener struct {
+	Enabled           string `yaml:"enabled"`
+	Address           string `yaml:"address"`
+	TransferPortRange string `yaml:"transfer_port_range"`
+}
+
+type SFTPListener struct {
+	Enabled        string   `yaml:"enabled"`
+	Address        string   `yaml:"address"`
+	AuthorizedKeys string   `yaml:"authorized_keys"`
+	HostKeys       []string `yaml:"host_keys"`
+}
+
+type NFSListener struct {
+	Enabled string `yaml:"enabled"`
+	Address string `yaml:"address"`
+	User    string `yaml:"user"`
+}
+
+type MetricsListener struct {
+	Address string `yaml:"address"` // /metrics is not served if empty
+}
+
+type AdminListener struct {
+	Address string `yaml:"address"` // the admin API is not served if empty
+	Token   string `yaml:"token"`
+}
+
+type Auth struct {
+	Mode      string `yaml:"mode"`
+	UsersFile string `yaml:"users_file"`
+	ACLFile   string `yaml:"acl_file"`
+}
+
+type Anonymous struct {
+	Enabled string `yaml:"enabled"`
+	Root    string `yaml:"root"`
+}
+
+type TLS struct {
+	Cert         string   `yaml:"cert"`
+	Key          string   `yaml:"key"`
+	TrustedCerts []string `yaml:"trusted_certs"`
+}
+
+type Limits struct {
+	ShutdownTimeout string `yaml:"shutdown_timeout"` // seconds
+	MaxConnections  string `yaml:"max_connections"`  // per protocol
+
+	HealthCheckInterval string `yaml:"health_check_interval"` // seconds between health checks of dufs servers
+}
+
+type Audit struct {
+	Output  string `yaml:"output"`   // JSON Lines file, - for stdout, disabled if empty
+	MaxSize string `yaml:"max_size"` // megabytes before the file is rotated
+	Backups string `yaml:"backups"`  // rotated files kept
+}
+
+// Load reads the config file, unknown keys are errors
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &File{}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	err = decoder.Decode(file)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	l.Info("Loaded config file", "path", path)
+
+	return file, nil
+}
+
+// Values returns the scalars of this file, keyed by the name of their environment variable
+func (f *File) Values() map[string]string {
+	if f == nil {
+		return nil
+	}
+
+	values := map[string]string{
+		env.DubrokerLogLevel:             f.LogLevel,
+		env.DubrokerLogFormat:            f.LogFormat,
+		env.DubrokerStateDir:             f.StateDir,
+		env.DubrokerFTPEnabled:           f.Listeners.FTP.Enabled,
+		env.DubrokerFTPAddr:              f.Listeners.FTP.Address,
+		env.DubrokerFTPTransferPortRange: f.Listeners.FTP.TransferPortRange,
+		env.DubrokerSFTPEnabled:          f.Listeners.SFTP.Enabled,
+		env.DubrokerSFTPAddr:             f.Listeners.SFTP.Address,
+		env.DubrokerSFTPAuthorizedKeys:   f.Listeners.SFTP.AuthorizedKeys,
+		env.DubrokerSFTPHostKeys:         strings.Join(f.Listeners.SFTP.HostKeys, ","),
+		env.DubrokerNFSEnabled:           f.Listeners.NFS.Enabled,
+		env.DubrokerNFSAddr:              f.Listeners.NFS.Address,
+		env.DubrokerNFSUser:              f.Listeners.NFS.User,
+		env.DubrokerMetricsAddr:          f.Listeners.Metrics.Address,
+		env.DubrokerAdminAddr:            f.Listeners.Admin.Address,
+		env.DubrokerAdminToken:           f.Listeners.Admin.Token,
+		env.DubrokerAuthMode:             f.Auth.Mode,
+		env.DubrokerUsersFile:            f.Auth.UsersFile,
+		env.DubrokerACLFile:              f.Auth.ACLFile,
+		env.DubrokerAnonymousEnabled:     f.Anonymous.Enabled,
+		env.DubrokerAnonymousRoot:        f.Anonymous.Root,
+		env.DubrokerTlsCertCrt:           f.TLS.Cert,
+		env.DubrokerTlsCertKey:           f.TLS.Key,
+		env.DubrokerTrustedCerts:         strings.Join(f.TLS.TrustedCerts, ","),
+		env.DubrokerShutdownTimeout:      f.Limits.ShutdownTimeout,
+		env.DubrokerMaxConnections:       f.Limits.MaxConnections,
+		env.DubrokerHealthCheckInterval:  f.Limits.HealthCheckInterval,
+		env.DubrokerAuditLog:             f.Audit.Output,
+		env.DubrokerAuditLogMaxSize:      f.Audit.MaxSize,
+		env.DubrokerAuditLogBackups:      f.Audit.Backups,
+	}
+
+	if len(f.Upstreams) == 1 && !f.Mounted() {
+		values[env.DubrokerDufsServer] = f.Upstreams[0].URL
+		values[env.DubrokerDufsReplicas] = strings.Join(f.Upstreams[0].Replicas, ",")
+		if f.Upstreams[0].PinWrites {
+			values[env.DubrokerPinWrites] = "true"
+		}
+	}
+
+	return values
+}
+
+// Validate reports every error in the parts of this file which have no environment variable
+func (f *File) Validate() error {
+	if f == nil {
+		return nil
+	}
+
+	var errs []error
+
+	mounted := f.Mounted() || len(f.Upstreams) > 1
+	mounts := map[string]bool{}
+	for i, upstream := range f.Upstreams {
+		if upstream.URL == "" {
+			errs = append(errs, fmt.Errorf("upstreams #%d: url is required", i+1))
+		} else if _, err := url.Parse(upstream.URL); err != nil {
+			errs = append(errs, fmt.Errorf("upstreams #%d: %w", i+1, err))
+		}
+		for _, replica := range upstream.Replicas {
+			if _, err := url.Parse(replica); err != nil {
+				errs = append(errs, fmt.Errorf("upstreams #%d: replicas: %w", i+1, err))
+			}
+		}
+
+		if !mounted {
+			continue
+		}
+
+		mount := strings.Trim(acl.Clean(upstream.Mount), "/")
+		if mount == "" || strings.Contains(mount, "/") {
+			errs = append(errs, fmt.Errorf("upstreams #%d: mount must be a top-level directory such as /media, got %q", i+1, upstream.Mount))
+		} else if mounts[mount] {
+			errs = append(errs, fmt.Errorf("upstreams #%d: mount %q is used more than once", i+1, upstream.Mount))
+		}
+		mounts[mount] = true
+	}
+
+	if len(f.Users) > 0 {
+		if f.Auth.UsersFile != "" {
+			errs = append(errs, errors.New("users: can not be used together with auth.users_file"))
+		}
+		if _, err := auth.NewStore(f.Users); err != nil {
+			errs = append(errs, fmt.Errorf("users: %w", err))
+		}
+	}
+
+	if len(f.Rules) > 0 {
+		if f.Auth.ACLFile != "" {
+			errs = append(errs, errors.New("rules: can not be used together with auth.acl_file"))
+		}
+		if _, err := acl.NewPolicy(f.Rules); err != nil {
+			errs = append(errs, fmt.Errorf("rules: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -2,10 +2,11 @@ package env
 
 import (
 	"crypto/x509"
-	"github.com/allape/goenv"
-	"github.com/allape/gogger"
+	"errors"
+	"github.com/allape/dufs-broker/logging"
 	"os"
 	"strings"
+	"sync/atomic"
 )
 
 const Banner = `
@@ -18,37 +19,196 @@ const Banner = `
 |______| |_______||___|    |_______|  |_______||___|  |_||_______||___| |_||_______||___|  |_|
 `
 
-var l = gogger.New("env")
+var l = logging.New("env")
+
+const (
+	AuthModeLocal       = "local"       // check credentials against UsersFile or the DufsServer URL
+	AuthModePassthrough = "passthrough" // forward credentials to dufs
+)
 
 const (
 	DubrokerDufsServer   = "DUBROKER_DUFS_SERVER"
+	DubrokerDufsReplicas = "DUBROKER_DUFS_REPLICAS"
+	DubrokerPinWrites    = "DUBROKER_PIN_WRITES"
 	DubrokerTrustedCerts = "DUBROKER_TRUSTED_CERTS"
-	DubrokerAddr         = "DUBROKER_ADDRESS"
+	DubrokerEnvFile      = "DUBROKER_ENV_FILE"
+	DubrokerConfigFile   = "DUBROKER_CONFIG"
+	DubrokerAddr         = "DUBROKER_ADDRESS" // deprecated: use DubrokerFTPAddr
+	DubrokerLogLevel     = "DUBROKER_LOG_LEVEL"
+	DubrokerLogFormat    = "DUBROKER_LOG_FORMAT"
+	GoggerLevel          = "GOGGER_LEVEL" // deprecated: use DubrokerLogLevel
+
+	DubrokerFTPEnabled  = "DUBROKER_FTP_ENABLED"
+	DubrokerFTPAddr     = "DUBROKER_FTP_ADDRESS"
+	DubrokerSFTPEnabled = "DUBROKER_SFTP_ENABLED"
+	DubrokerSFTPAddr    = "DUBROKER_SFTP_ADDRESS"
+	DubrokerNFSEnabled  = "DUBROKER_NFS_ENABLED"
+	DubrokerNFSAddr     = "DUBROKER_NFS_ADDRESS"
+	DubrokerMetricsAddr = "DUBROKER_METRICS_ADDRESS"
+	DubrokerAdminAddr   = "DUBROKER_ADMIN_ADDRESS"
+	DubrokerAdminToken  = "DUBROKER_ADMIN_TOKEN"
+
+	DubrokerSFTPAuthorizedKeys = "DUBROKER_SFTP_AUTHORIZED_KEYS"
+	DubrokerSFTPHostKeys       = "DUBROKER_SFTP_HOST_KEYS"
+
+	DubrokerStateDir = "DUBROKER_STATE_DIR"
+
+	DubrokerUsersFile = "DUBROKER_USERS_FILE"
+	DubrokerAuthMode  = "DUBROKER_AUTH_MODE"
+	DubrokerACLFile   = "DUBROKER_ACL_FILE"
+	DubrokerNFSUser   = "DUBROKER_NFS_USER"
+
+	DubrokerAnonymousEnabled = "DUBROKER_ANONYMOUS_ENABLED"
+	DubrokerAnonymousRoot    = "DUBROKER_ANONYMOUS_ROOT"
 
 	DubrokerTlsCertCrt = "DUBROKER_TLS_CERT_CRT"
 	DubrokerTlsCertKey = "DUBROKER_TLS_CERT_KEY"
 
 	DubrokerFTPTransferPortRange = "DUBROKER_FTP_TRANSFER_PORT_RANGE"
+
+	DubrokerShutdownTimeout = "DUBROKER_SHUTDOWN_TIMEOUT"
+	DubrokerMaxConnections  = "DUBROKER_MAX_CONNECTIONS"
+
+	DubrokerHealthCheckInterval = "DUBROKER_HEALTH_CHECK_INTERVAL"
+
+	DubrokerAuditLog        = "DUBROKER_AUDIT_LOG"
+	DubrokerAuditLogMaxSize = "DUBROKER_AUDIT_LOG_MAX_SIZE"
+	DubrokerAuditLogBackups = "DUBROKER_AUDIT_LOG_BACKUPS"
 )
 
 var (
-	DufsServer   = goenv.Getenv(DubrokerDufsServer, "http://localhost:5000")
-	TrustedCerts = goenv.Getenv(DubrokerTrustedCerts, "")
+	DufsServer   string
+	DufsReplicas string // comma separated, dufs servers sharing the files of DufsServer
+	PinWrites    bool   // send writes to DufsServer only, instead of any replica online
+	TrustedCerts string
+	EnvFile      string // KEY=VALUE lines applied to the environment at start and on SIGHUP
+	ConfigFile   string // YAML, environment variables win over its values
+	LogLevel     string
+	LogFormat    string // text or json
+
+	FTPEnabled  bool
+	FTPAddr     string
+	SFTPEnabled bool
+	SFTPAddr    string
+	NFSEnabled  bool
+	NFSAddr     string
+	MetricsAddr string // /metrics is not served if empty
+	AdminAddr   string // the admin API is not served if empty
+	AdminToken  string // bearer token of the admin API
 
-	//Addr         = goenv.Getenv(DubrokerAddr, "127.0.0.1:2049") // nfs
-	//Addr         = goenv.Getenv(DubrokerAddr, "127.0.0.1:2022") // sftp
-	Addr = goenv.Getenv(DubrokerAddr, "127.0.0.1:2021")
+	SFTPAuthorizedKeys string
+	SFTPHostKeys       string // comma separated, generated in StateDir if empty
 
-	TlsCertCrt = goenv.Getenv(DubrokerTlsCertCrt, "") // warn: VLC does not support TLS
-	TlsCertKey = goenv.Getenv(DubrokerTlsCertKey, "")
+	StateDir string
 
-	FTPTransferPortRange = goenv.Getenv(DubrokerFTPTransferPortRange, PortRange("50000-50100"))
+	UsersFile string // users in the DufsServer URL only if empty
+	AuthMode  string
+	ACLFile   string // everything is allowed if empty
+	NFSUser   string // NFS has no login, ACL rules of this user apply to it
+
+	AnonymousEnabled bool // read-only FTP login as anonymous or ftp
+	AnonymousRoot    string
+
+	TlsCertCrt string // warn: VLC does not support TLS
+	TlsCertKey string
+
+	FTPTransferPortRange PortRange
+
+	ShutdownTimeout int // seconds to wait for transfers in flight on exit
+	MaxConnections  int // per protocol, unlimited if 0
+
+	HealthCheckInterval int // seconds between health checks of dufs servers and their replicas
+
+	AuditLog        string // JSON Lines file of file operations and failed logins, - for stdout, disabled if empty
+	AuditLogMaxSize int    // megabytes the audit log grows to before it is rotated, never if 0
+	AuditLogBackups int    // rotated audit logs kept
 )
 
+// Snapshot holds the settings read by the servers while they run, a reload publishes a new one instead of changing it
+type Snapshot struct {
+	TlsCertCrt           string
+	TlsCertKey           string
+	FTPTransferPortRange PortRange
+}
+
+var current atomic.Pointer[Snapshot]
+
+// Current is the snapshot of the last Load, safe to read from any goroutine
+func Current() *Snapshot {
+	return current.Load()
+}
+
+func init() {
+	_ = Load()
+}
+
+// Load (re)reads every setting from the environment, then from the config file set by SetFile
+func Load() error {
+	var errs []error
+
+	DufsServer = get(&errs, DubrokerDufsServer, "http://localhost:5000")
+	DufsReplicas = get(&errs, DubrokerDufsReplicas, "")
+	PinWrites = get(&errs, DubrokerPinWrites, false)
+	TrustedCerts = get(&errs, DubrokerTrustedCerts, "")
+	EnvFile = get(&errs, DubrokerEnvFile, "")
+	ConfigFile = get(&errs, DubrokerConfigFile, "")
+	LogLevel = get(&errs, DubrokerLogLevel, get(&errs, GoggerLevel, "info"))
+	LogFormat = get(&errs, DubrokerLogFormat, logging.FormatText)
+
+	FTPEnabled = get(&errs, DubrokerFTPEnabled, true)
+	FTPAddr = get(&errs, DubrokerFTPAddr, get(&errs, DubrokerAddr, "127.0.0.1:2021"))
+	SFTPEnabled = get(&errs, DubrokerSFTPEnabled, false)
+	SFTPAddr = get(&errs, DubrokerSFTPAddr, "127.0.0.1:2022")
+	NFSEnabled = get(&errs, DubrokerNFSEnabled, false)
+	NFSAddr = get(&errs, DubrokerNFSAddr, "127.0.0.1:2049")
+	MetricsAddr = get(&errs, DubrokerMetricsAddr, "")
+	AdminAddr = get(&errs, DubrokerAdminAddr, "")
+	AdminToken = get(&errs, DubrokerAdminToken, "")
+
+	SFTPAuthorizedKeys = get(&errs, DubrokerSFTPAuthorizedKeys, "")
+	SFTPHostKeys = get(&errs, DubrokerSFTPHostKeys, "")
+
+	StateDir = get(&errs, DubrokerStateDir, "state")
+
+	UsersFile = get(&errs, DubrokerUsersFile, "")
+	AuthMode = get(&errs, DubrokerAuthMode, AuthModeLocal)
+	ACLFile = get(&errs, DubrokerACLFile, "")
+	NFSUser = get(&errs, DubrokerNFSUser, "nfs")
+
+	AnonymousEnabled = get(&errs, DubrokerAnonymousEnabled, false)
+	AnonymousRoot = get(&errs, DubrokerAnonymousRoot, "/")
+
+	TlsCertCrt = get(&errs, DubrokerTlsCertCrt, "")
+	TlsCertKey = get(&errs, DubrokerTlsCertKey, "")
+
+	FTPTransferPortRange = get(&errs, DubrokerFTPTransferPortRange, PortRange("50000-50100"))
+
+	ShutdownTimeout = get(&errs, DubrokerShutdownTimeout, 30)
+	MaxConnections = get(&errs, DubrokerMaxConnections, 0)
+
+	HealthCheckInterval = get(&errs, DubrokerHealthCheckInterval, 10)
+
+	AuditLog = get(&errs, DubrokerAuditLog, "")
+	AuditLogMaxSize = get(&errs, DubrokerAuditLogMaxSize, 100)
+	AuditLogBackups = get(&errs, DubrokerAuditLogBackups, 5)
+
+	current.Store(&Snapshot{
+		TlsCertCrt:           TlsCertCrt,
+		TlsCertKey:           TlsCertKey,
+		FTPTransferPortRange: FTPTransferPortRange,
+	})
+
+	return errors.Join(errs...)
+}
+
 func TrustedCertsPoolFromEnv() (*x509.CertPool, error) {
-	l.Info().Println("TrustedCerts:", TrustedCerts)
+	l.Info("Trusted certs", "files", TrustedCerts)
+	return TrustedCertsPool(TrustedCerts)
+}
 
-	certs := strings.Split(TrustedCerts, ",")
+// TrustedCertsPool loads the comma separated CA files in trustedCerts
+func TrustedCertsPool(trustedCerts string) (*x509.CertPool, error) {
+	certs := strings.Split(trustedCerts, ",")
 
 	caCertPool := x509.NewCertPool()
 
@@ -66,3 +226,15 @@ func TrustedCertsPoolFromEnv() (*x509.CertPool, error) {
 
 	return caCertPool, nil
 }
+
+// Split returns the non-empty items of a comma separated setting
+func Split(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
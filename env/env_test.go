@@ -0,0 +1,32 @@
+package env
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCurrent(t *testing.T) {
+	t.Setenv(DubrokerTlsCertCrt, "old.crt")
+	_ = Load()
+	old := Current()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_ = Current().TlsCertCrt
+		}
+	}()
+
+	t.Setenv(DubrokerTlsCertCrt, "new.crt")
+	_ = Load()
+	wg.Wait()
+
+	if old.TlsCertCrt != "old.crt" {
+		t.Errorf("Expected old.crt in the old snapshot but got %q", old.TlsCertCrt)
+	}
+	if crt := Current().TlsCertCrt; crt != "new.crt" {
+		t.Errorf("Expected new.crt but got %q", crt)
+	}
+}
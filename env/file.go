@@ -0,0 +1,70 @@
+package env
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// fileKeys are the environment variables set by LoadFile, which it may set again
+var fileKeys = map[string]bool{}
+
+// LoadFile applies the KEY=VALUE lines of file to the environment of this process,
+// variables set by other means are kept.
+// Blank lines and lines starting with # are skipped.
+func LoadFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	values, err := parseFile(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+
+	for key, value := range values {
+		if _, ok := os.LookupEnv(key); ok && !fileKeys[key] {
+			continue
+		}
+		err = os.Setenv(key, value)
+		if err != nil {
+			return err
+		}
+		fileKeys[key] = true
+	}
+
+	return nil
+}
+
+func parseFile(r io.Reader) (map[string]string, error) {
+	values := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", i)
+		}
+
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		values[key] = value
+	}
+
+	return values, scanner.Err()
+}
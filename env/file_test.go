@@ -0,0 +1,41 @@
+package env
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseFile(t *testing.T) {
+	values, err := parseFile(strings.NewReader(`
+# comment
+DUBROKER_USERS_FILE=/etc/dubroker/users.yaml
+export GOGGER_LEVEL = debug
+DUBROKER_ANONYMOUS_ROOT="/pub lic"
+DUBROKER_ACL_FILE=
+`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := map[string]string{
+		"DUBROKER_USERS_FILE":     "/etc/dubroker/users.yaml",
+		"GOGGER_LEVEL":            "debug",
+		"DUBROKER_ANONYMOUS_ROOT": "/pub lic",
+		"DUBROKER_ACL_FILE":       "",
+	}
+
+	if len(values) != len(expected) {
+		t.Errorf("Expected %d values but got %d", len(expected), len(values))
+	}
+
+	for key, value := range expected {
+		if values[key] != value {
+			t.Errorf("Expected %s=%q but got %q", key, value, values[key])
+		}
+	}
+
+	_, err = parseFile(strings.NewReader("DUBROKER_USERS_FILE"))
+	if err == nil {
+		t.Errorf("Expected error but got nil")
+	}
+}
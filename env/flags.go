@@ -0,0 +1,81 @@
+package env
+
+import (
+	"flag"
+	"os"
+	"strings"
+)
+
+type Setting struct {
+	Key   string
+	Usage string
+	Bool  bool
+}
+
+// Settings are the environment variables which can be given as flags
+var Settings = []Setting{
+	{Key: DubrokerConfigFile, Usage: "YAML config file, environment variables and flags win over its values"},
+	{Key: DubrokerEnvFile, Usage: "file of KEY=VALUE lines applied to the environment at start and on SIGHUP"},
+	{Key: DubrokerLogLevel, Usage: "log level: error, warn, info, debug, verbose or off"},
+	{Key: DubrokerLogFormat, Usage: "log format: text or json"},
+	{Key: DubrokerDufsServer, Usage: "URL of the dufs server, with the default credentials"},
+	{Key: DubrokerDufsReplicas, Usage: "comma separated URLs of dufs servers sharing the files of the dufs server, for failover"},
+	{Key: DubrokerPinWrites, Usage: "send writes to the dufs server only, instead of any replica online", Bool: true},
+	{Key: DubrokerHealthCheckInterval, Usage: "seconds between health checks of dufs servers"},
+	{Key: DubrokerTrustedCerts, Usage: "comma separated CA files trusted for https dufs servers"},
+	{Key: DubrokerStateDir, Usage: "directory for generated host keys and other state"},
+	{Key: DubrokerFTPEnabled, Usage: "serve FTP", Bool: true},
+	{Key: DubrokerFTPAddr, Usage: "FTP listen address, every interface if it starts with :"},
+	{Key: DubrokerFTPTransferPortRange, Usage: "FTP passive transfer ports, as start-end"},
+	{Key: DubrokerSFTPEnabled, Usage: "serve SFTP", Bool: true},
+	{Key: DubrokerSFTPAddr, Usage: "SFTP listen address"},
+	{Key: DubrokerSFTPAuthorizedKeys, Usage: "authorized_keys file, the comment of each key is the user name"},
+	{Key: DubrokerSFTPHostKeys, Usage: "comma separated SFTP host key files, generated in the state dir if empty"},
+	{Key: DubrokerNFSEnabled, Usage: "serve NFS", Bool: true},
+	{Key: DubrokerNFSAddr, Usage: "NFS listen address"},
+	{Key: DubrokerNFSUser, Usage: "user whose home, credentials and ACL rules apply to NFS"},
+	{Key: DubrokerMetricsAddr, Usage: "listen address of the Prometheus /metrics endpoint, disabled if empty"},
+	{Key: DubrokerAdminAddr, Usage: "listen address of the admin API, disabled if empty"},
+	{Key: DubrokerAdminToken, Usage: "bearer token of the admin API"},
+	{Key: DubrokerAuthMode, Usage: "local or passthrough"},
+	{Key: DubrokerUsersFile, Usage: "YAML users file"},
+	{Key: DubrokerACLFile, Usage: "YAML ACL rules file"},
+	{Key: DubrokerAnonymousEnabled, Usage: "allow read-only anonymous FTP login", Bool: true},
+	{Key: DubrokerAnonymousRoot, Usage: "directory anonymous FTP users are jailed into"},
+	{Key: DubrokerTlsCertCrt, Usage: "FTP TLS certificate file"},
+	{Key: DubrokerTlsCertKey, Usage: "FTP TLS key file"},
+	{Key: DubrokerShutdownTimeout, Usage: "seconds to wait for transfers in flight on exit"},
+	{Key: DubrokerMaxConnections, Usage: "connections per protocol, unlimited if 0"},
+	{Key: DubrokerAuditLog, Usage: "JSON Lines audit log of file operations and failed logins, - for stdout, disabled if empty"},
+	{Key: DubrokerAuditLogMaxSize, Usage: "megabytes the audit log grows to before it is rotated, never if 0"},
+	{Key: DubrokerAuditLogBackups, Usage: "rotated audit logs kept"},
+}
+
+// Flag is the name of the flag of this setting, DUBROKER_FTP_ADDRESS is ftp-address
+func (s Setting) Flag() string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimPrefix(s.Key, "DUBROKER_")), "_", "-")
+}
+
+// RegisterFlags adds a flag for every setting to flags,
+// a flag given on the command line sets its environment variable, so it wins over everything else
+func RegisterFlags(flags *flag.FlagSet) {
+	for _, setting := range Settings {
+		flags.Var(&settingFlag{setting: setting}, setting.Flag(), setting.Usage+" ($"+setting.Key+")")
+	}
+}
+
+type settingFlag struct {
+	setting Setting
+}
+
+func (f *settingFlag) String() string {
+	return ""
+}
+
+func (f *settingFlag) Set(value string) error {
+	return os.Setenv(f.setting.Key, value)
+}
+
+func (f *settingFlag) IsBoolFlag() bool {
+	return f.setting.Bool
+}
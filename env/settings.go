@@ -0,0 +1,179 @@
+package env
+
+import (
+	"errors"
+	"fmt"
+	"github.com/allape/dufs-broker/logging"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	fileLocker sync.Mutex
+	fileValues map[string]string
+
+	effectiveLocker sync.Mutex
+	effective       = map[string]string{} // the value of every setting loaded, defaults included
+)
+
+// SetFile sets the values of the config file, keyed by the name of their environment variable,
+// they are used by Load when the environment variable is empty
+func SetFile(values map[string]string) {
+	fileLocker.Lock()
+	defer fileLocker.Unlock()
+	fileValues = values
+}
+
+// lookup returns the value of key and where it comes from
+func lookup(key string) (string, string) {
+	if value := os.Getenv(key); value != "" {
+		return value, "environment"
+	}
+
+	fileLocker.Lock()
+	defer fileLocker.Unlock()
+
+	return fileValues[key], "config file"
+}
+
+// get parses the value of key, the default value is used and an error is appended to errs if it is invalid
+func get[T string | bool | int | PortRange](errs *[]error, key string, defaultValue T) (result T) {
+	defer func() {
+		effectiveLocker.Lock()
+		effective[key] = fmt.Sprint(result)
+		effectiveLocker.Unlock()
+	}()
+
+	value, from := lookup(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	var v any
+	var err error
+
+	switch any(defaultValue).(type) {
+	case bool:
+		v, err = strconv.ParseBool(value)
+	case int:
+		v, err = strconv.Atoi(value)
+	case PortRange:
+		v = PortRange(value)
+	default:
+		v = value
+	}
+
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("%s from %s: invalid value %q", key, from, value))
+		return defaultValue
+	}
+
+	return v.(T)
+}
+
+// Effective returns the value of every setting as loaded, with the passwords in URLs and tokens hidden
+func Effective() map[string]string {
+	effectiveLocker.Lock()
+	defer effectiveLocker.Unlock()
+
+	values := make(map[string]string, len(effective))
+	for key, value := range effective {
+		switch key {
+		case DubrokerDufsServer, DubrokerDufsReplicas:
+			urls := Split(value)
+			for i, u := range urls {
+				urls[i] = Redact(u)
+			}
+			value = strings.Join(urls, ",")
+		case DubrokerAdminToken:
+			if value != "" {
+				value = "xxxxx"
+			}
+		}
+		values[key] = value
+	}
+
+	return values
+}
+
+// Redact hides the password in rawURL
+func Redact(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Redacted()
+}
+
+// Validate checks the loaded settings and reports every invalid one
+func Validate() error {
+	var errs []error
+
+	if DufsServer == "" {
+		errs = append(errs, fmt.Errorf("%s: dufs server address is required", DubrokerDufsServer))
+	} else if _, err := url.Parse(DufsServer); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", DubrokerDufsServer, err))
+	}
+
+	for _, replica := range Split(DufsReplicas) {
+		if _, err := url.Parse(replica); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", DubrokerDufsReplicas, err))
+		}
+	}
+
+	if !FTPEnabled && !SFTPEnabled && !NFSEnabled {
+		errs = append(errs, errors.New("at least one of FTP, SFTP and NFS must be enabled"))
+	}
+
+	if FTPEnabled {
+		if _, _, err := FTPTransferPortRange.Range(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", DubrokerFTPTransferPortRange, err))
+		}
+	}
+
+	if AuthMode != AuthModeLocal && AuthMode != AuthModePassthrough {
+		errs = append(errs, fmt.Errorf("%s: unknown auth mode %q", DubrokerAuthMode, AuthMode))
+	}
+
+	if AdminAddr != "" && AdminToken == "" {
+		errs = append(errs, fmt.Errorf("%s is required by %s", DubrokerAdminToken, DubrokerAdminAddr))
+	}
+
+	if (TlsCertCrt == "") != (TlsCertKey == "") {
+		errs = append(errs, fmt.Errorf("%s and %s must be set together", DubrokerTlsCertCrt, DubrokerTlsCertKey))
+	}
+
+	if _, err := logging.ParseLevel(LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", DubrokerLogLevel, err))
+	}
+
+	if _, err := logging.NewHandler(io.Discard, LogFormat); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", DubrokerLogFormat, err))
+	}
+
+	if ShutdownTimeout < 0 {
+		errs = append(errs, fmt.Errorf("%s: must not be negative", DubrokerShutdownTimeout))
+	}
+
+	if MaxConnections < 0 {
+		errs = append(errs, fmt.Errorf("%s: must not be negative", DubrokerMaxConnections))
+	}
+
+	if HealthCheckInterval <= 0 {
+		errs = append(errs, fmt.Errorf("%s: must be positive", DubrokerHealthCheckInterval))
+	}
+
+	if AuditLogMaxSize < 0 {
+		errs = append(errs, fmt.Errorf("%s: must not be negative", DubrokerAuditLogMaxSize))
+	}
+
+	if AuditLogBackups < 0 {
+		errs = append(errs, fmt.Errorf("%s: must not be negative", DubrokerAuditLogBackups))
+	}
+
+	return errors.Join(errs...)
+}
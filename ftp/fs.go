@@ -2,7 +2,7 @@ package ftp
 
 import (
 	"errors"
-	"github.com/allape/gohtvfs"
+	"github.com/allape/dufs-broker/vfs"
 	ftpserver "github.com/fclairamb/ftpserverlib"
 	"github.com/spf13/afero"
 	"os"
@@ -13,63 +13,68 @@ var NotImplemented = errors.New("not implemented")
 
 type DufsClientDriver struct {
 	ftpserver.ClientDriver
-	dufs *gohtvfs.DufsVFS
+	fs vfs.FS
 }
 
 func (d *DufsClientDriver) Create(name string) (afero.File, error) {
-	return d.Open(name)
+	return d.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
 }
 
 func (d *DufsClientDriver) Mkdir(name string, perm os.FileMode) error {
-	return d.dufs.Mkdir(name, perm)
+	return d.fs.Mkdir(name, perm)
 }
 
 func (d *DufsClientDriver) MkdirAll(path string, perm os.FileMode) error {
-	return d.dufs.Mkdir(path, perm)
+	return d.fs.Mkdir(path, perm)
 }
 
 func (d *DufsClientDriver) Open(name string) (afero.File, error) {
-	file, err := d.dufs.Open(name)
+	file, err := d.fs.Open(name)
 	if err != nil {
 		return nil, err
 	}
 	return &DufsAferoFile{
-		file: file.(*gohtvfs.DufsFile),
+		file: file,
 	}, nil
 }
 
-func (d *DufsClientDriver) OpenFile(name string, _ int, _ os.FileMode) (afero.File, error) {
-	file, err := d.Open(name)
+// OpenFile honours O_CREATE, O_EXCL, O_TRUNC and O_APPEND for STOR and APPE, perm is ignored
+func (d *DufsClientDriver) OpenFile(name string, flag int, _ os.FileMode) (afero.File, error) {
+	file, err := vfs.OpenFile(d.fs, name, flag)
 	if err != nil {
 		return nil, err
 	}
 
-	stat, err := file.Stat()
+	stat, err := file.CachedStat()
 	if err != nil {
+		_ = file.Close()
 		return nil, err
 	}
 
 	if stat.IsDir() {
+		_ = file.Close()
 		return nil, os.ErrInvalid
 	}
 
-	return file, nil
+	return &DufsAferoFile{
+		file: file,
+	}, nil
 }
 
 func (d *DufsClientDriver) Remove(name string) error {
-	return d.dufs.Remove(name)
+	return d.fs.Remove(name)
 }
 
 func (d *DufsClientDriver) RemoveAll(path string) error {
-	return d.dufs.Remove(path)
+	return d.fs.Remove(path)
 }
 
 func (d *DufsClientDriver) Rename(oldname, newname string) error {
-	return d.dufs.Rename(oldname, newname)
+	return d.fs.Rename(oldname, newname)
 }
 
 func (d *DufsClientDriver) Stat(name string) (os.FileInfo, error) {
-	state, err := d.dufs.Stat(name)
+	state, err := d.fs.Stat(name)
 	if err != nil {
 		return nil, err
 	}
@@ -90,17 +95,19 @@ func (d *DufsClientDriver) Chown(_ string, _, _ int) error {
 	return NotImplemented
 }
 
-func (d *DufsClientDriver) Chtimes(_ string, _ time.Time, _ time.Time) error {
-	return NotImplemented
+// Chtimes is how MFMT sets the modification time, there is no access time
+func (d *DufsClientDriver) Chtimes(name string, _ time.Time, mtime time.Time) error {
+	return d.fs.Chtimes(name, mtime)
 }
 
 type DufsAferoFile struct {
 	afero.File
-	file *gohtvfs.DufsFile
+	file    vfs.File
+	aborted bool // by TransferError, Close has nothing left to do
 }
 
 func (f *DufsAferoFile) Name() string {
-	return f.file.Name
+	return f.file.Name()
 }
 
 func (f *DufsAferoFile) Readdir(count int) ([]os.FileInfo, error) {
@@ -120,12 +127,8 @@ func (f *DufsAferoFile) Readdir(count int) ([]os.FileInfo, error) {
 
 	fileInfos := make([]os.FileInfo, len(files))
 	for i, file := range files {
-		info, err := file.Info()
-		if err != nil {
-			return nil, err
-		}
 		fileInfos[i] = &DufsAferoFileInfo{
-			fileInfo: info,
+			fileInfo: file,
 		}
 	}
 
@@ -159,8 +162,8 @@ func (f *DufsAferoFile) Sync() error {
 	return err
 }
 
-func (f *DufsAferoFile) Truncate(_ int64) error {
-	return NotImplemented
+func (f *DufsAferoFile) Truncate(size int64) error {
+	return vfs.Truncate(f.file, size)
 }
 
 func (f *DufsAferoFile) WriteString(s string) (int, error) {
@@ -168,9 +171,19 @@ func (f *DufsAferoFile) WriteString(s string) (int, error) {
 }
 
 func (f *DufsAferoFile) Close() error {
+	if f.aborted {
+		return nil
+	}
 	return f.file.Close()
 }
 
+// TransferError cuts off the upload of a STOR or APPE whose transfer failed,
+// so dufs does not keep what was received as if it were the whole file
+func (f *DufsAferoFile) TransferError(err error) {
+	f.aborted = true
+	_ = vfs.Abort(f.file, err)
+}
+
 func (f *DufsAferoFile) Read(p []byte) (n int, err error) {
 	stat, err := f.file.CachedStat()
 	if err != nil {
@@ -0,0 +1,130 @@
+package ftp
+
+import (
+	"errors"
+	"github.com/allape/dufs-broker/vfs"
+	ftpserver "github.com/fclairamb/ftpserverlib"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"testing"
+)
+
+// memFS keeps files in memory, and answers like DufsVFS does
+type memFS struct {
+	vfs.FS
+	locker sync.Mutex
+	files  map[string][]byte
+}
+
+func (m *memFS) Open(name string) (vfs.File, error) {
+	return &memFile{
+		fs:   m,
+		name: name,
+	}, nil
+}
+
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	content, ok := m.files[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return &memInfo{
+		name: name,
+		size: int64(len(content)),
+	}, nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	delete(m.files, name)
+	return nil
+}
+
+type memFile struct {
+	vfs.File
+	fs   *memFS
+	name string
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	return f.fs.Stat(f.name)
+}
+
+func (f *memFile) CachedStat() (fs.FileInfo, error) {
+	return f.fs.Stat(f.name)
+}
+
+// ReadFrom replaces the file, like a PUT, which fails if its body is cut off
+func (f *memFile) ReadFrom(r io.Reader) (int64, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(content)), err
+	}
+
+	f.fs.locker.Lock()
+	defer f.fs.locker.Unlock()
+
+	f.fs.files[f.name] = content
+	return int64(len(content)), nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+type memInfo struct {
+	fs.FileInfo
+	name string
+	size int64
+}
+
+func (i *memInfo) Name() string { return i.name }
+func (i *memInfo) Size() int64  { return i.size }
+func (i *memInfo) IsDir() bool  { return false }
+
+func TestTransferError(t *testing.T) {
+	cases := []struct {
+		name    string
+		failed  bool
+		content string // of /a, which does not exist if empty
+	}{
+		{"complete", false, "abcdef"},
+		{"failed", true, ""},
+	}
+
+	for _, c := range cases {
+		m := &memFS{
+			files: map[string][]byte{},
+		}
+		driver := &DufsClientDriver{
+			fs: m,
+		}
+
+		// as STOR opens it
+		file, err := driver.OpenFile("/a", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o666)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		_, _ = file.Write([]byte("abc"))
+		_, _ = file.Write([]byte("def"))
+		if c.failed {
+			file.(ftpserver.FileTransferError).TransferError(errors.New("connection reset by peer"))
+		}
+		_ = file.Close()
+
+		content, ok := m.files["/a"]
+		if c.content == "" && ok {
+			t.Errorf("Expected no file for %s but got %q", c.name, content)
+		} else if c.content != "" && string(content) != c.content {
+			t.Errorf("Expected %q for %s but got %q", c.content, c.name, content)
+		}
+	}
+}
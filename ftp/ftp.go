@@ -1,71 +1,138 @@
 package ftp
 
 import (
+	"context"
 	"crypto/tls"
 	_ "embed"
-	"fmt"
+	"github.com/allape/dufs-broker/audit"
+	"github.com/allape/dufs-broker/auth"
 	"github.com/allape/dufs-broker/env"
 	"github.com/allape/dufs-broker/ipnet"
-	"github.com/allape/gogger"
-	"github.com/allape/gohtvfs"
+	"github.com/allape/dufs-broker/logging"
+	"github.com/allape/dufs-broker/metrics"
+	"github.com/allape/dufs-broker/session"
 	ftpserver "github.com/fclairamb/ftpserverlib"
-	"net/url"
+	"net"
+	"sync"
 )
 
 const Name = "DUFS FTP Server"
 
-var l = gogger.New("ftp")
+var l = logging.New("ftp")
 
-func Start(u *url.URL, dufs *gohtvfs.DufsVFS) error {
-	addrs, err := ipnet.DescriptAddress(env.Addr)
+// Server is every listener started by Start
+type Server struct {
+	registry *session.Registry
+}
+
+// Shutdown stops accepting clients, waits for transfers until ctx is done, then disconnects every client
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.registry.Shutdown(ctx)
+}
+
+func Start(addr string, authenticator auth.Authenticator, builder *session.Builder) (*Server, error) {
+	err := LoadCertificate()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	addrs, err := ipnet.DescriptAddress(addr)
+	if err != nil {
+		return nil, err
 	}
 
+	server := &Server{
+		registry: session.NewRegistry("ftp", env.MaxConnections),
+	}
+
+	metrics.Sessions.Func(func() float64 {
+		return float64(server.registry.Connections())
+	}, "ftp")
+
+	// read on every scrape, so it shows the range of the last reload
+	metrics.PassivePorts.Func(func() float64 {
+		pStart, pEnd, err := env.Current().FTPTransferPortRange.Range()
+		if err != nil {
+			return 0
+		}
+		return float64(pEnd - pStart + 1)
+	})
+
 	for _, addr := range addrs {
-		go start(addr, u, dufs)
+		err = server.start(addr, authenticator, builder)
+		if err != nil {
+			_ = server.Shutdown(context.Background())
+			return nil, err
+		}
 	}
 
-	return nil
+	return server, nil
 }
 
-func start(addr string, u *url.URL, dufs *gohtvfs.DufsVFS) {
-	server := ftpserver.NewFtpServer(&DufsDriver{
-		addr: addr,
-		u:    u,
-		dufs: dufs,
-	})
-	server.Logger = NewLogger(l)
+func (s *Server) start(addr string, authenticator auth.Authenticator, builder *session.Builder) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	listener = &offlineListener{
+		Listener: s.registry.Listener(listener),
+		online:   builder.Online,
+	}
 
-	l.Info().Println("FTP server started", "addr", addr)
+	driver := &DufsDriver{
+		addr:          addr,
+		listener:      listener,
+		authenticator: authenticator,
+		builder:       builder,
+		registry:      s.registry,
+	}
+
+	server := ftpserver.NewFtpServer(driver)
+	server.Logger = NewLogger(l, &driver.sessions)
 
-	err := server.ListenAndServe()
+	err = server.Listen()
 	if err != nil {
-		l.Error().Println("FTP server error", "error", err)
+		return err
 	}
+
+	l.Info("FTP server started", "addr", addr)
+
+	go func() {
+		err := server.Serve()
+		if err != nil {
+			l.Error("FTP server error", "error", err)
+		}
+	}()
+
+	return nil
 }
 
 type DufsDriver struct {
 	ftpserver.MainDriver
-	addr string
-	u    *url.URL
-	dufs *gohtvfs.DufsVFS
+	addr          string
+	listener      net.Listener
+	authenticator auth.Authenticator
+	builder       *session.Builder
+	registry      *session.Registry
+	sessions      sync.Map // FTP client ID to *session.Session, for the logs of ftpserverlib
 }
 
 func (d *DufsDriver) GetSettings() (*ftpserver.Settings, error) {
-	pStart, pEnd, err := env.FTPTransferPortRange.Range()
+	pStart, pEnd, err := env.Current().FTPTransferPortRange.Range()
 	if err != nil {
 		return nil, err
 	}
 
 	tlsMode := ftpserver.MandatoryEncryption
 
-	if env.TlsCertCrt == "" || env.TlsCertKey == "" {
+	if !TLSEnabled() {
 		tlsMode = ftpserver.ClearOrEncrypted
 	}
 
 	return &ftpserver.Settings{
 		ListenAddr:  d.addr,
+		Listener:    d.listener,
 		Banner:      env.Banner,
 		TLSRequired: tlsMode,
 		PassiveTransferPortRange: &ftpserver.PortRange{
@@ -76,49 +143,80 @@ func (d *DufsDriver) GetSettings() (*ftpserver.Settings, error) {
 }
 
 func (d *DufsDriver) ClientConnected(cc ftpserver.ClientContext) (string, error) {
-	l.Debug().Println("Client connected", cc.ID(), cc.Path())
+	logger := l
+	if s := d.registry.Session(nil, cc.RemoteAddr()); s != nil {
+		d.sessions.Store(cc.ID(), s)
+		logger = s.Logger(l)
+	}
+	logger.Debug("Client connected", "clientId", cc.ID())
 	return Name, nil
 }
 
 func (d *DufsDriver) ClientDisconnected(cc ftpserver.ClientContext) {
-	l.Debug().Println("Client disconnected", cc.ID(), cc.Path())
+	logger := l
+	if s, ok := d.sessions.LoadAndDelete(cc.ID()); ok {
+		logger = s.(*session.Session).Logger(l)
+	}
+	logger.Debug("Client disconnected", "clientId", cc.ID(), "path", cc.Path())
 }
 
-func (d *DufsDriver) AuthUser(_ ftpserver.ClientContext, user, pass string) (ftpserver.ClientDriver, error) {
-	if d.u.User.Username() == "" {
-		return &DufsClientDriver{
-			dufs: d.dufs,
-		}, nil
+func (d *DufsDriver) AuthUser(cc ftpserver.ClientContext, user, pass string) (ftpserver.ClientDriver, error) {
+	u, err := d.authenticator.Authenticate(user, pass)
+	if err != nil {
+		metrics.AuthAttempts.Inc("ftp", "failure")
+		audit.LoginFailed("ftp", user, cc.RemoteAddr(), err)
+		return nil, err
 	}
+	metrics.AuthAttempts.Inc("ftp", "success")
 
-	if user == d.u.User.Username() {
-		if password, ok := d.u.User.Password(); ok && pass == password {
-			return &DufsClientDriver{
-				dufs: d.dufs,
-			}, nil
-		}
-	}
+	s := d.registry.Session(nil, cc.RemoteAddr())
 
-	return nil, fmt.Errorf("invalid user or password")
-}
+	fs, err := d.builder.FS(u, s)
+	if err != nil {
+		return nil, err
+	}
 
-func (d *DufsDriver) GetTLSConfig() (*tls.Config, error) {
-	var tlsConfig *tls.Config
+	fs = metrics.Count(fs, "ftp", u.Name)
+	fs = audit.Wrap(fs, "ftp", u.Name, u.Home, audit.IP(cc.RemoteAddr()))
 
-	if env.TlsCertCrt == "" || env.TlsCertKey == "" {
-		return tlsConfig, nil
+	if s != nil {
+		s.Login(u.Name)
+		s.Logger(l).Info("Logged in")
+		fs = s.Track(fs)
+	} else {
+		fs = d.registry.Track(fs)
 	}
 
-	l.Info().Println("Using TLS", "cert", env.TlsCertCrt, "key", env.TlsCertKey)
+	return &DufsClientDriver{
+		fs: fs,
+	}, nil
+}
 
-	cert, err := tls.LoadX509KeyPair(env.TlsCertCrt, env.TlsCertKey)
-	if err != nil {
-		return nil, err
+// WrapPassiveListener counts the passive data connections
+func (d *DufsDriver) WrapPassiveListener(listener net.Listener) (net.Listener, error) {
+	metrics.PassiveListens.Inc()
+	return &passiveListener{
+		Listener: listener,
+	}, nil
+}
+
+// GetTLSConfig fails if TLS is turned on by a reload whose certificate failed to load
+func (d *DufsDriver) GetTLSConfig() (*tls.Config, error) {
+	if !TLSEnabled() {
+		return nil, nil
 	}
 
-	tlsConfig = &tls.Config{
-		Certificates: []tls.Certificate{cert},
+	if certificate.Load() == nil {
+		return nil, ErrNoCertificate
 	}
 
-	return tlsConfig, nil
+	return &tls.Config{
+		GetCertificate: func(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert := certificate.Load()
+			if cert == nil {
+				return nil, ErrNoCertificate
+			}
+			return cert, nil
+		},
+	}, nil
 }
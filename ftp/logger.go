@@ -1,45 +1,66 @@
 package ftp
 
 import (
-	"github.com/allape/gogger"
+	"context"
+	"github.com/allape/dufs-broker/session"
 	"github.com/fclairamb/go-log"
+	"log/slog"
+	"sync"
 )
 
+// Logger passes the logs of ftpserverlib to slog,
+// with the session of the client once it is connected
 type Logger struct {
-	log.Logger
-	keyvals []any
-	gogger  *gogger.Logger
+	logger   *slog.Logger
+	sessions *sync.Map // FTP client ID to *session.Session
+	clientID any       // set by ftpserverlib for the logger of each client
 }
 
-func (l Logger) Debug(event string, keyvals ...interface{}) {
-	l.gogger.Debug().Println(l.keyvals, event, keyvals)
+func (l Logger) log(level slog.Level, event string, keyvals []any) {
+	logger := l.logger
+	if l.clientID != nil {
+		if s, ok := l.sessions.Load(l.clientID); ok {
+			logger = s.(*session.Session).Logger(logger)
+		}
+	}
+	logger.Log(context.Background(), level, event, keyvals...)
 }
 
-func (l Logger) Info(event string, keyvals ...interface{}) {
-	l.gogger.Info().Println(l.keyvals, event, keyvals)
+func (l Logger) Debug(event string, keyvals ...any) {
+	l.log(slog.LevelDebug, event, keyvals)
 }
 
-func (l Logger) Warn(event string, keyvals ...interface{}) {
-	l.gogger.Warn().Println(l.keyvals, event, keyvals)
+func (l Logger) Info(event string, keyvals ...any) {
+	l.log(slog.LevelInfo, event, keyvals)
 }
 
-func (l Logger) Error(event string, keyvals ...interface{}) {
-	l.gogger.Error().Println(l.keyvals, event, keyvals)
+func (l Logger) Warn(event string, keyvals ...any) {
+	l.log(slog.LevelWarn, event, keyvals)
 }
 
-func (l Logger) Panic(event string, keyvals ...interface{}) {
-	l.gogger.Error().Fatalln(l.keyvals, event, keyvals)
+func (l Logger) Error(event string, keyvals ...any) {
+	l.log(slog.LevelError, event, keyvals)
 }
 
-func (l Logger) With(keyvals ...interface{}) log.Logger {
-	return Logger{
-		keyvals: keyvals,
-		gogger:  l.gogger,
+func (l Logger) Panic(event string, keyvals ...any) {
+	l.log(slog.LevelError, event, keyvals)
+	panic(event)
+}
+
+func (l Logger) With(keyvals ...any) log.Logger {
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] == "clientId" {
+			l.clientID = keyvals[i+1]
+		}
 	}
+	l.logger = l.logger.With(keyvals...)
+	return l
 }
 
-func NewLogger(g *gogger.Logger) log.Logger {
+// NewLogger logs to logger, sessions maps FTP client IDs to the sessions they belong to
+func NewLogger(logger *slog.Logger, sessions *sync.Map) log.Logger {
 	return Logger{
-		gogger: g,
+		logger:   logger,
+		sessions: sessions,
 	}
 }
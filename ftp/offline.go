@@ -0,0 +1,70 @@
+package ftp
+
+import (
+	"fmt"
+	ftpserver "github.com/fclairamb/ftpserverlib"
+	"net"
+	"time"
+)
+
+var offlineReply = fmt.Sprintf("%d Service not available, the dufs server is offline, try again later\r\n", ftpserver.StatusServiceNotAvailable)
+
+// offlineListener turns clients away with 421 while every dufs server is offline,
+// instead of letting them log in to fail on every command
+type offlineListener struct {
+	net.Listener
+	online func() bool
+}
+
+func (o *offlineListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := o.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if o.online() {
+			return &offlineConn{
+				Conn:   conn,
+				online: o.online,
+			}, nil
+		}
+
+		l.Warn("Dufs server is offline, turned away", "remote_addr", conn.RemoteAddr())
+
+		_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		_, _ = fmt.Fprint(conn, offlineReply)
+		_ = conn.Close()
+	}
+}
+
+// offlineConn is the control connection of a client who got in while dufs was online.
+// An error reply sent once every dufs server is offline, which is what the failure of a command is then,
+// is replaced by 421 and the connection is closed, as RFC 959 has it for a service shutting down.
+type offlineConn struct {
+	net.Conn
+	online func() bool
+}
+
+// Write gets a whole reply line at a time, ftpserverlib flushes every line
+func (o *offlineConn) Write(p []byte) (int, error) {
+	if len(p) < 4 || (p[0] != '4' && p[0] != '5') || o.online() {
+		return o.Conn.Write(p)
+	}
+
+	// the last line of a multi-line reply is replaced, the others are left out
+	if p[3] == '-' {
+		return len(p), nil
+	}
+
+	l.Warn("Dufs server is offline, disconnected", "remote_addr", o.RemoteAddr())
+
+	_ = o.Conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := fmt.Fprint(o.Conn, offlineReply)
+	_ = o.Conn.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,41 @@
+package ftp
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestOfflineConn(t *testing.T) {
+	cases := []struct {
+		name    string
+		online  bool
+		replies []string
+		sent    string
+	}{
+		{"online", true, []string{"550 Could not access file\r\n"}, "550 Could not access file\r\n"},
+		{"success while offline", false, []string{"257 \"/\" is the current directory\r\n"}, "257 \"/\" is the current directory\r\n"},
+		{"error while offline", false, []string{"550 Could not access file\r\n"}, offlineReply},
+		{"multi-line error while offline", false, []string{"550-first\r\n", "550 last\r\n"}, offlineReply},
+	}
+
+	for _, c := range cases {
+		server, client := net.Pipe()
+		conn := &offlineConn{
+			Conn:   server,
+			online: func() bool { return c.online },
+		}
+
+		go func() {
+			for _, reply := range c.replies {
+				_, _ = conn.Write([]byte(reply))
+			}
+			_ = server.Close()
+		}()
+
+		sent, _ := io.ReadAll(client)
+		if string(sent) != c.sent {
+			t.Errorf("Expected %q for %s but got %q", c.sent, c.name, sent)
+		}
+	}
+}
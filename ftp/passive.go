@@ -0,0 +1,36 @@
+package ftp
+
+import (
+	"github.com/allape/dufs-broker/metrics"
+	"net"
+	"sync"
+)
+
+// passiveListener counts the data connections it accepts until they are closed.
+// ftpserverlib closes the listener itself behind it, so a port which is listened on without a connection is not counted.
+type passiveListener struct {
+	net.Listener
+}
+
+func (p *passiveListener) Accept() (net.Conn, error) {
+	conn, err := p.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	metrics.PassiveConnections.Add(1)
+	return &passiveConn{
+		Conn: conn,
+	}, nil
+}
+
+type passiveConn struct {
+	net.Conn
+	once sync.Once
+}
+
+func (p *passiveConn) Close() error {
+	p.once.Do(func() {
+		metrics.PassiveConnections.Add(-1)
+	})
+	return p.Conn.Close()
+}
@@ -0,0 +1,37 @@
+package ftp
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/allape/dufs-broker/env"
+	"sync/atomic"
+)
+
+var ErrNoCertificate = errors.New("TLS certificate is not loaded")
+
+// certificate is served to new TLS connections, and replaced by LoadCertificate without restarting the listeners
+var certificate atomic.Pointer[tls.Certificate]
+
+func TLSEnabled() bool {
+	settings := env.Current()
+	return settings.TlsCertCrt != "" && settings.TlsCertKey != ""
+}
+
+// LoadCertificate (re)loads the certificate from the TLS settings of env.Current
+func LoadCertificate() error {
+	settings := env.Current()
+	if settings.TlsCertCrt == "" || settings.TlsCertKey == "" {
+		return nil
+	}
+
+	l.Info("Using TLS", "cert", settings.TlsCertCrt, "key", settings.TlsCertKey)
+
+	cert, err := tls.LoadX509KeyPair(settings.TlsCertCrt, settings.TlsCertKey)
+	if err != nil {
+		return err
+	}
+
+	certificate.Store(&cert)
+
+	return nil
+}
@@ -6,8 +6,6 @@ replace github.com/fclairamb/ftpserverlib => github.com/allape/ftpserverlib v0.0
 
 require (
 	github.com/allape/go-http-vfs v0.0.0-20250210093330-3572b6e3d275
-	github.com/allape/goenv v0.0.0-20241202051618-ce41afb81ebf
-	github.com/allape/gogger v0.0.0-20241208090122-dda745ad2428
 	github.com/allape/gohtvfs v0.0.0-20250210125608-2707ce82c590
 	github.com/fclairamb/ftpserverlib v0.25.0
 	github.com/fclairamb/go-log v0.5.0
@@ -16,6 +14,8 @@ require (
 	github.com/spf13/afero v1.12.0
 	github.com/willscott/go-nfs v0.0.3
 	golang.org/x/crypto v0.33.0
+	golang.org/x/term v0.29.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
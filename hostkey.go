@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/allape/dufs-broker/env"
+	"github.com/allape/dufs-broker/sftp"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"slices"
+	"strings"
+)
+
+// genHostKey writes new SFTP host keys, into the state dir unless -out is given
+func genHostKey(args []string) error {
+	flags := flag.NewFlagSet("gen-hostkey", flag.ExitOnError)
+	types := flags.String("type", strings.Join(sftp.HostKeyTypes, ","), "comma separated key types: "+strings.Join(sftp.HostKeyTypes, ", "))
+	out := flags.String("out", "", "key file, only for a single type, the public key is written next to it with .pub")
+	force := flags.Bool("force", false, "overwrite existing keys")
+	env.RegisterFlags(flags)
+	_ = flags.Parse(args)
+
+	_ = env.Load()
+
+	keyTypes := strings.Split(*types, ",")
+	if *out != "" && len(keyTypes) > 1 {
+		return errors.New("-out needs a single -type")
+	}
+
+	for _, keyType := range keyTypes {
+		keyType = strings.TrimSpace(keyType)
+		if !slices.Contains(sftp.HostKeyTypes, keyType) {
+			return fmt.Errorf("%w: %s", sftp.ErrUnsupportedHostKeyType, keyType)
+		}
+
+		path := *out
+		if path == "" {
+			path = sftp.HostKeyPath(env.StateDir, keyType)
+		}
+
+		if _, err := os.Stat(path); err == nil && !*force {
+			return fmt.Errorf("%s exists, use -force to overwrite it", path)
+		}
+
+		key, err := sftp.GenerateHostKey(keyType)
+		if err != nil {
+			return err
+		}
+
+		err = sftp.WriteHostKey(path, key)
+		if err != nil {
+			return err
+		}
+
+		publicKey, err := ssh.NewPublicKey(key.Public())
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(path, ssh.FingerprintSHA256(publicKey))
+	}
+
+	return nil
+}
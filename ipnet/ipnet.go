@@ -2,12 +2,12 @@ package ipnet
 
 import (
 	"fmt"
-	"github.com/allape/gogger"
+	"github.com/allape/dufs-broker/logging"
 	"net"
 	"strings"
 )
 
-var l = gogger.New("ipnet")
+var l = logging.New("ipnet")
 
 func DescriptAddress(addr string) ([]string, error) {
 	if strings.HasPrefix(addr, ":") {
@@ -21,7 +21,7 @@ func DescriptAddress(addr string) ([]string, error) {
 		for _, iface := range interfaces {
 			addrs, err := iface.Addrs()
 			if err != nil {
-				l.Warn().Println("Error getting addresses for interface:", iface.Name, err)
+				l.Warn("Failed to get the addresses of an interface", "interface", iface.Name, "error", err)
 				continue
 			}
 
@@ -0,0 +1,140 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+const (
+	LevelVerbose = slog.LevelDebug - 4
+	LevelOff     = slog.LevelError + 100
+)
+
+var (
+	level slog.LevelVar
+	base  atomic.Pointer[slog.Handler] // the handler of the format in use
+)
+
+func init() {
+	setBase(slog.NewTextHandler(os.Stderr, options()))
+	slog.SetDefault(slog.New(&handler{}))
+}
+
+// New creates the logger of a package, its lines follow the level and format set by Init
+func New(pkg string) *slog.Logger {
+	return slog.New(&handler{}).With("pkg", pkg)
+}
+
+// Init sets the level and the format of every logger, it may be called again to change them
+func Init(levelName, format string) error {
+	lvl, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+
+	h, err := NewHandler(os.Stderr, format)
+	if err != nil {
+		return err
+	}
+
+	level.Set(lvl)
+	setBase(h)
+
+	return nil
+}
+
+// NewHandler writes to w in format, text or json
+func NewHandler(w io.Writer, format string) (slog.Handler, error) {
+	switch strings.ToLower(format) {
+	case FormatText:
+		return slog.NewTextHandler(w, options()), nil
+	case FormatJSON:
+		return slog.NewJSONHandler(w, options()), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, text or json", format)
+	}
+}
+
+// ParseLevel parses off, error, warn, info, debug or verbose, in any case
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "off":
+		return LevelOff, nil
+	case "error":
+		return slog.LevelError, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "verbose":
+		return LevelVerbose, nil
+	default:
+		return 0, fmt.Errorf("unknown log level %q, off, error, warn, info, debug or verbose", name)
+	}
+}
+
+func options() *slog.HandlerOptions {
+	return &slog.HandlerOptions{
+		Level: &level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.LevelKey && a.Value.Any() == LevelVerbose {
+				a.Value = slog.StringValue("VERBOSE")
+			}
+			return a
+		},
+	}
+}
+
+func setBase(h slog.Handler) {
+	base.Store(&h)
+}
+
+// handler passes records to the base handler in use at the time,
+// so loggers created before Init follow it
+type handler struct {
+	wraps []func(slog.Handler) slog.Handler // WithAttrs and WithGroup, in order
+}
+
+func (h *handler) Enabled(_ context.Context, lvl slog.Level) bool {
+	return lvl >= level.Level()
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	b := *base.Load()
+	for _, wrap := range h.wraps {
+		b = wrap(b)
+	}
+	return b.Handle(ctx, r)
+}
+
+func (h *handler) with(wrap func(slog.Handler) slog.Handler) slog.Handler {
+	wraps := make([]func(slog.Handler) slog.Handler, len(h.wraps), len(h.wraps)+1)
+	copy(wraps, h.wraps)
+	return &handler{
+		wraps: append(wraps, wrap),
+	}
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(b slog.Handler) slog.Handler {
+		return b.WithAttrs(attrs)
+	})
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(b slog.Handler) slog.Handler {
+		return b.WithGroup(name)
+	})
+}
@@ -0,0 +1,64 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	cases := []struct {
+		name  string
+		level slog.Level
+		ok    bool
+	}{
+		{"off", LevelOff, true},
+		{"ERROR", slog.LevelError, true},
+		{"Warn", slog.LevelWarn, true},
+		{"info", slog.LevelInfo, true},
+		{"debug", slog.LevelDebug, true},
+		{"verbose", LevelVerbose, true},
+		{"trace", 0, false},
+	}
+
+	for _, c := range cases {
+		level, err := ParseLevel(c.name)
+		if (err == nil) != c.ok || level != c.level {
+			t.Errorf("Expected %v, %v for %q but got %v, %v", c.level, c.ok, c.name, level, err)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	logger := New("test").With("session", 1)
+
+	var buf bytes.Buffer
+	h, err := NewHandler(&buf, FormatJSON)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	setBase(h)
+	level.Set(slog.LevelInfo)
+
+	logger.Debug("hidden")
+	logger.Info("shown", "user", "alice")
+
+	var line map[string]any
+	err = json.Unmarshal(buf.Bytes(), &line)
+	if err != nil {
+		t.Fatalf("Expected a single JSON line but got %q: %v", buf.String(), err)
+	}
+
+	expected := map[string]any{
+		"msg":     "shown",
+		"pkg":     "test",
+		"session": float64(1),
+		"user":    "alice",
+	}
+	for key, value := range expected {
+		if line[key] != value {
+			t.Errorf("Expected %s=%v but got %v", key, value, line[key])
+		}
+	}
+}
@@ -2,74 +2,240 @@ package main
 
 import (
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/allape/dufs-broker/acl"
+	"github.com/allape/dufs-broker/auth"
+	"github.com/allape/dufs-broker/config"
 	"github.com/allape/dufs-broker/env"
-	"github.com/allape/dufs-broker/ftp"
-	"github.com/allape/gogger"
-	"github.com/allape/gohtvfs"
-	"net/http"
-	"net/url"
+	"github.com/allape/dufs-broker/logging"
+	"github.com/allape/dufs-broker/upstream"
 	"os"
-	"os/signal"
-	"syscall"
+	"strings"
 )
 
-var l = gogger.New("main")
+var l = logging.New("main")
+
+type command struct {
+	name  string
+	args  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"serve", "[flags] [dufs-url]", "run the broker, the default", serve},
+	{"check", "[flags] [dufs-url]", "check the configuration, the dufs server and the files it refers to", check},
+	{"hash-password", "[-cost n]", "read a password and print its bcrypt hash for the users file", hashPassword},
+	{"gen-hostkey", "[-type t] [-out file] [-force] [flags]", "generate SFTP host keys", genHostKey},
+	{"version", "", "print version and build info", printVersion},
+}
+
+func usage() {
+	_, _ = fmt.Fprintf(os.Stderr, "Usage: %s <command> [arguments]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		_, _ = fmt.Fprintf(os.Stderr, "  %s %s\n      %s\n", c.name, c.args, c.usage)
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "\nRun %s <command> -h for the flags of a command.\n", os.Args[0])
+}
 
 func main() {
-	if len(os.Args) >= 2 {
-		env.DufsServer = os.Args[1]
+	args := os.Args[1:]
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "help", "-h", "-help", "--help":
+			usage()
+			return
+		}
+	}
+
+	c, args, ok := dispatch(args)
+	if !ok {
+		_, _ = fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", args[0])
+		usage()
+		os.Exit(2)
 	}
 
-	err := gogger.InitFromEnv()
+	err := c.run(args)
 	if err != nil {
-		l.Error().Fatalf("Failed to initialize logger: %v", err)
+		l.Error(err.Error())
+		os.Exit(1)
 	}
+}
+
+// dispatch returns the command named by the first of args and the arguments left for it.
+// A bare dufs URL or flags without a command run serve, as before commands existed.
+// It reports false for a first argument that is neither.
+func dispatch(args []string) (command, []string, bool) {
+	serve := commands[0]
 
-	if env.DufsServer == "" {
-		l.Error().Fatalf("Dufs Server Address is required")
+	if len(args) == 0 {
+		return serve, args, true
 	}
 
-	l.Info().Println("Dufs Server:", env.DufsServer)
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c, args[1:], true
+		}
+	}
 
-	u, err := url.Parse(env.DufsServer)
-	if err != nil {
-		l.Error().Fatalf("Failed to parse DufsServer URL: %v", err)
+	return serve, args, isServeArg(args[0])
+}
+
+// isServeArg reports whether arg starts the arguments of serve without naming it, a flag or a dufs URL,
+// so a mistyped command is not taken for the host name of a dufs server
+func isServeArg(arg string) bool {
+	lower := strings.ToLower(arg)
+	return strings.HasPrefix(arg, "-") || strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// loadConfig applies env.EnvFile and env.ConfigFile, and reports every invalid setting
+func loadConfig() (*config.File, error) {
+	_ = env.Load() // for env.EnvFile and env.ConfigFile given by flags, errors are reported below
+
+	if env.EnvFile != "" {
+		err := env.LoadFile(env.EnvFile)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	caCertPool, err := env.TrustedCertsPoolFromEnv()
-	if err != nil {
-		l.Error().Fatalf("Failed to create TrustedCertsPool: %v", err)
+	var file *config.File
+	if env.ConfigFile != "" {
+		var err error
+		file, err = config.Load(env.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
 	}
-	tlsConfig := &tls.Config{
-		RootCAs: caCertPool,
+
+	env.SetFile(file.Values())
+
+	return file, errors.Join(env.Load(), env.Validate(), file.Validate())
+}
+
+// initLogger applies the log level and format, which may come from the config file
+func initLogger() error {
+	return logging.Init(env.LogLevel, env.LogFormat)
+}
+
+// upstreams are the dufs servers mounted by the config file, or env.DufsServer at the root
+func upstreams(file *config.File) []config.Upstream {
+	if file.Mounted() || (file != nil && len(file.Upstreams) > 1) {
+		return file.Upstreams
 	}
 
-	dufs, err := gohtvfs.NewDufsVFS(env.DufsServer)
-	if err != nil {
-		l.Error().Fatalf("Failed to create DufsVFS: %v", err)
+	root := config.Upstream{
+		URL:       env.DufsServer,
+		Mount:     "/",
+		Replicas:  env.Split(env.DufsReplicas),
+		PinWrites: env.PinWrites,
 	}
-	dufs.HttpClient.Transport = &http.Transport{
-		TLSClientConfig: tlsConfig,
+	if file != nil && len(file.Upstreams) == 1 {
+		root.Name = file.Upstreams[0].Name
+		root.TrustedCerts = file.Upstreams[0].TrustedCerts
 	}
-	dufs.SetLogger(gogger.New("dufs").Debug())
 
-	ok, _ := dufs.Online(nil)
-	if !ok {
-		l.Warn().Println("Dufs server is offline for now")
-	} else {
-		l.Info().Println("Dufs server is online")
+	return []config.Upstream{root}
+}
+
+// mount is a dufs server, with the transport its trusted CAs are reloaded into
+// and the pool of its replicas
+type mount struct {
+	upstream  config.Upstream
+	transport *upstream.Transport
+	pool      *upstream.Pool
+	factory   *upstream.Factory
+}
+
+func loadMounts(file *config.File) ([]*mount, error) {
+	var mounts []*mount
+
+	for _, u := range upstreams(file) {
+		tlsConfig, err := loadTLSConfig(u)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load trusted certs of %s: %w", u.Mount, err)
+		}
+
+		transport := upstream.NewTransport(tlsConfig)
+
+		pool, err := upstream.NewPool(append([]string{u.URL}, u.Replicas...), transport, u.PinWrites)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dufs server of %s: %w", u.Mount, err)
+		}
+
+		factory, err := upstream.NewFactory(u.URL, pool)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create DufsVFS factory of %s: %w", u.Mount, err)
+		}
+
+		mounts = append(mounts, &mount{
+			upstream:  u,
+			transport: transport,
+			pool:      pool,
+			factory:   factory,
+		})
 	}
 
-	err = ftp.Start(u, dufs)
+	return mounts, nil
+}
+
+// loadTLSConfig trusts env.TrustedCerts and the CAs of u
+func loadTLSConfig(u config.Upstream) (*tls.Config, error) {
+	caCertPool, err := env.TrustedCertsPool(strings.Join(append([]string{env.TrustedCerts}, u.TrustedCerts...), ","))
 	if err != nil {
-		l.Error().Fatalf("Failed to start FTP server: %v", err)
+		return nil, err
 	}
+	return &tls.Config{
+		RootCAs: caCertPool,
+	}, nil
+}
 
-	l.Info().Println(env.Banner)
+// loadAuthenticator returns the users in env.UsersFile or the config file if any, and the authenticator of env.AuthMode.
+// Credentials are checked against every dufs server in passthrough mode,
+// and against the URL of the first one when there is no user.
+func loadAuthenticator(mounts []*mount, file *config.File) (*auth.Store, auth.Authenticator, error) {
+	var users *auth.Store
+	var err error
+	if env.UsersFile != "" {
+		users, err = auth.LoadStore(env.UsersFile)
+	} else if file != nil && len(file.Users) > 0 {
+		users, err = auth.NewStore(file.Users)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
 
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	switch env.AuthMode {
+	case env.AuthModeLocal:
+		if users != nil {
+			return users, users, nil
+		}
+		return nil, &auth.SingleUser{
+			Userinfo: mounts[0].factory.Root().User,
+			Open:     !env.AnonymousEnabled,
+		}, nil
+	case env.AuthModePassthrough:
+		factories := make([]*upstream.Factory, len(mounts))
+		for i, m := range mounts {
+			factories[i] = m.factory
+		}
+		return users, &auth.Passthrough{
+			Factories: factories,
+			Users:     users,
+		}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown auth mode: %s", env.AuthMode)
+	}
+}
 
-	sig := <-sigs
-	l.Info().Println("Exiting with", sig)
+// loadPolicy returns nil, which allows everything, if there is neither env.ACLFile nor rules in the config file
+func loadPolicy(file *config.File) (*acl.Policy, error) {
+	if env.ACLFile != "" {
+		return acl.LoadPolicy(env.ACLFile)
+	} else if file != nil && len(file.Rules) > 0 {
+		return acl.NewPolicy(file.Rules)
+	}
+	return nil, nil
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDispatch(t *testing.T) {
+	cases := []struct {
+		args    []string
+		command string // empty if rejected
+		rest    []string
+	}{
+		{nil, "serve", nil},
+		{[]string{"serve", "http://dufs:5000"}, "serve", []string{"http://dufs:5000"}},
+		{[]string{"check", "-ftp-enabled=false"}, "check", []string{"-ftp-enabled=false"}},
+		{[]string{"hash-password", "-cost", "4"}, "hash-password", []string{"-cost", "4"}},
+		{[]string{"gen-hostkey", "-type", "ed25519"}, "gen-hostkey", []string{"-type", "ed25519"}},
+		{[]string{"version"}, "version", []string{}},
+		{[]string{"http://dufs:5000"}, "serve", []string{"http://dufs:5000"}},
+		{[]string{"HTTPS://dufs"}, "serve", []string{"HTTPS://dufs"}},
+		{[]string{"-ftp-addr", ":21"}, "serve", []string{"-ftp-addr", ":21"}},
+		{[]string{"chek"}, "", nil},
+		{[]string{"dufs:5000"}, "", nil},
+	}
+
+	for _, c := range cases {
+		command, rest, ok := dispatch(c.args)
+
+		if c.command == "" {
+			if ok {
+				t.Errorf("Expected %v to be rejected but got %s", c.args, command.name)
+			}
+			continue
+		}
+
+		if !ok || command.name != c.command || strings.Join(rest, " ") != strings.Join(c.rest, " ") {
+			t.Errorf("Expected %s %v for %v but got %s %v (%t)", c.command, c.rest, c.args, command.name, rest, ok)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	stdin, input, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	output, stdout, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	oldStdin, oldStdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = stdin, stdout
+	defer func() {
+		os.Stdin, os.Stdout = oldStdin, oldStdout
+	}()
+
+	_, _ = io.WriteString(input, "correct horse\n")
+	_ = input.Close()
+
+	err = hashPassword([]string{"-cost", "4"})
+	_ = stdout.Close()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	printed, _ := io.ReadAll(output)
+	hash := strings.TrimSpace(string(printed))
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte("correct horse")) != nil {
+		t.Errorf("Expected a bcrypt hash of the password but got %q", hash)
+	}
+	if cost, err := bcrypt.Cost([]byte(hash)); err != nil || cost != 4 {
+		t.Errorf("Expected a cost of 4 but got %d, %v", cost, err)
+	}
+}
@@ -0,0 +1,26 @@
+package metrics
+
+var (
+	Sessions     = NewGauge("dubroker_sessions", "Connected clients.", "protocol")
+	AuthAttempts = NewCounter("dubroker_auth_attempts_total", "Logins by result, success or failure.", "protocol", "result")
+	Bytes        = NewCounter("dubroker_bytes_total", "Bytes clients read from or wrote to dufs, by direction, read or write.", "protocol", "user", "direction")
+
+	UpstreamRequests = NewCounter("dubroker_upstream_requests_total", "HTTP requests to dufs, by status code, or error if there is no response.", "method", "status")
+	UpstreamDuration = NewHistogram("dubroker_upstream_request_duration_seconds", "Time until the response headers of dufs.", DurationBuckets, "method")
+	UpstreamUp       = NewGauge("dubroker_upstream_up", "Whether a dufs server passed its last health check.", "url")
+	UpstreamLatency  = NewGauge("dubroker_upstream_health_check_seconds", "Duration of the last health check of a dufs server.", "url")
+
+	NFSHandleLookups = NewCounter("dubroker_nfs_handle_lookups_total", "Lookups of NFS file handles in the handle cache, by result, hit or miss.", "result")
+
+	PassivePorts       = NewGauge("dubroker_ftp_passive_ports", "Size of the FTP passive transfer port range.")
+	PassiveListens     = NewCounter("dubroker_ftp_passive_listens_total", "Ports of the FTP passive transfer port range listened on.")
+	PassiveConnections = NewGauge("dubroker_ftp_passive_connections", "Open FTP passive data connections, each of which holds a port of the range.")
+)
+
+// Bool is 1 for true, for gauges
+func Bool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
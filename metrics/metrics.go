@@ -0,0 +1,220 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// family is a metric with a series for each combination of label values
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64 // upper bounds, for histograms
+
+	locker sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	value  float64
+	fn     func() float64 // instead of value, for gauges
+	counts []uint64       // per bucket, for histograms
+	sum    float64
+	count  uint64
+}
+
+var families []*family
+
+func newFamily(name, help, kind string, labels []string) *family {
+	f := &family{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: map[string]*series{},
+	}
+	families = append(families, f)
+	return f
+}
+
+// with calls fn with the series of values under the lock
+func (f *family) with(values []string, fn func(s *series)) {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s wants %d label value(s), got %d", f.name, len(f.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\x00")
+
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{
+			values: append([]string(nil), values...),
+		}
+		f.series[key] = s
+	}
+
+	fn(s)
+}
+
+// Counter only goes up
+type Counter struct {
+	*family
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{newFamily(name, help, "counter", labels)}
+}
+
+func (c *Counter) Add(v float64, values ...string) {
+	c.with(values, func(s *series) {
+		s.value += v
+	})
+}
+
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Gauge goes up and down
+type Gauge struct {
+	*family
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{newFamily(name, help, "gauge", labels)}
+}
+
+func (g *Gauge) Set(v float64, values ...string) {
+	g.with(values, func(s *series) {
+		s.value = v
+	})
+}
+
+func (g *Gauge) Add(v float64, values ...string) {
+	g.with(values, func(s *series) {
+		s.value += v
+	})
+}
+
+// Func makes fn the value of the series, it is called on every scrape
+func (g *Gauge) Func(fn func() float64, values ...string) {
+	g.with(values, func(s *series) {
+		s.fn = fn
+	})
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	*family
+}
+
+// DurationBuckets are in seconds, from 5ms to 10s
+var DurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	f := newFamily(name, help, "histogram", labels)
+	f.buckets = buckets
+	return &Histogram{f}
+}
+
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.with(values, func(s *series) {
+		if s.counts == nil {
+			s.counts = make([]uint64, len(h.buckets))
+		}
+		for i, bucket := range h.buckets {
+			if v <= bucket {
+				s.counts[i]++
+			}
+		}
+		s.sum += v
+		s.count++
+	})
+}
+
+// Write writes every metric in the Prometheus text format
+func Write(w io.Writer) error {
+	for _, f := range families {
+		err := f.write(w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *family) write(w io.Writer) error {
+	f.locker.Lock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	_, _ = fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+
+	for _, key := range keys {
+		s := f.series[key]
+		labels := f.labelPairs(s.values)
+
+		if f.kind != "histogram" {
+			value := s.value
+			if s.fn != nil {
+				value = s.fn()
+			}
+			_, _ = fmt.Fprintf(&sb, "%s%s %s\n", f.name, braces(labels), format(value))
+			continue
+		}
+
+		for i, bucket := range f.buckets {
+			_, _ = fmt.Fprintf(&sb, "%s_bucket%s %d\n", f.name, braces(append(labels, pair("le", format(bucket)))), s.counts[i])
+		}
+		_, _ = fmt.Fprintf(&sb, "%s_bucket%s %d\n", f.name, braces(append(labels, pair("le", "+Inf"))), s.count)
+		_, _ = fmt.Fprintf(&sb, "%s_sum%s %s\n", f.name, braces(labels), format(s.sum))
+		_, _ = fmt.Fprintf(&sb, "%s_count%s %d\n", f.name, braces(labels), s.count)
+	}
+	f.locker.Unlock()
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func (f *family) labelPairs(values []string) []string {
+	pairs := make([]string, len(values), len(values)+1)
+	for i, value := range values {
+		pairs[i] = pair(f.labels[i], value)
+	}
+	return pairs
+}
+
+func pair(name, value string) string {
+	return name + `="` + escaper.Replace(value) + `"`
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func braces(pairs []string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func format(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
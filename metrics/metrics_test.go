@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	counter := NewCounter("test_total", "Test counter.", "user")
+	counter.Inc(`a"b`)
+	counter.Add(2, "c")
+
+	gauge := NewGauge("test_gauge", "Test gauge.")
+	gauge.Func(func() float64 {
+		return 1.5
+	})
+
+	histogram := NewHistogram("test_seconds", "Test histogram.", []float64{.1, 1}, "method")
+	histogram.Observe(.05, "GET")
+	histogram.Observe(.5, "GET")
+
+	cases := []struct {
+		family   *family
+		expected string
+	}{
+		{counter.family, "# HELP test_total Test counter.\n# TYPE test_total counter\n" +
+			"test_total{user=\"a\\\"b\"} 1\ntest_total{user=\"c\"} 2\n"},
+		{gauge.family, "# HELP test_gauge Test gauge.\n# TYPE test_gauge gauge\ntest_gauge 1.5\n"},
+		{histogram.family, "# HELP test_seconds Test histogram.\n# TYPE test_seconds histogram\n" +
+			"test_seconds_bucket{method=\"GET\",le=\"0.1\"} 1\n" +
+			"test_seconds_bucket{method=\"GET\",le=\"1\"} 2\n" +
+			"test_seconds_bucket{method=\"GET\",le=\"+Inf\"} 2\n" +
+			"test_seconds_sum{method=\"GET\"} 0.55\n" +
+			"test_seconds_count{method=\"GET\"} 2\n"},
+	}
+
+	for _, c := range cases {
+		var sb strings.Builder
+		if err := c.family.write(&sb); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if sb.String() != c.expected {
+			t.Errorf("Expected %q but got %q", c.expected, sb.String())
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/allape/dufs-broker/logging"
+	"net"
+	"net/http"
+	"time"
+)
+
+var l = logging.New("metrics")
+
+// Handler serves every metric in the Prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		err := Write(w)
+		if err != nil {
+			l.Debug("Failed to write metrics", "error", err)
+		}
+	})
+}
+
+// Server serves /metrics over HTTP
+type Server struct {
+	server *http.Server
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+func Start(addr string) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	server := &Server{
+		server: &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+
+	l.Info("Metrics served", "url", "http://"+listener.Addr().String()+"/metrics")
+
+	go func() {
+		err := server.server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			l.Error("Failed to serve metrics", "error", err)
+		}
+	}()
+
+	return server, nil
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"github.com/allape/dufs-broker/vfs"
+	"io"
+)
+
+// Count adds the bytes read from and written to the files of fsys to Bytes
+func Count(fsys vfs.FS, protocol, user string) vfs.FS {
+	return &countedFS{
+		FS:       fsys,
+		protocol: protocol,
+		user:     user,
+	}
+}
+
+type countedFS struct {
+	vfs.FS
+	protocol string
+	user     string
+}
+
+func (c *countedFS) Open(name string) (vfs.File, error) {
+	file, err := c.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &countedFile{
+		File: file,
+		fs:   c,
+	}, nil
+}
+
+type countedFile struct {
+	vfs.File
+	fs *countedFS
+}
+
+func (c *countedFile) count(direction string, n int64) {
+	if n > 0 {
+		Bytes.Add(float64(n), c.fs.protocol, c.fs.user, direction)
+	}
+}
+
+func (c *countedFile) Read(p []byte) (int, error) {
+	n, err := c.File.Read(p)
+	c.count("read", int64(n))
+	return n, err
+}
+
+func (c *countedFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.File.ReadAt(p, off)
+	c.count("read", int64(n))
+	return n, err
+}
+
+func (c *countedFile) Write(p []byte) (int, error) {
+	n, err := c.File.Write(p)
+	c.count("write", int64(n))
+	return n, err
+}
+
+func (c *countedFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := c.File.WriteAt(p, off)
+	c.count("write", int64(n))
+	return n, err
+}
+
+func (c *countedFile) ReadFrom(r io.Reader) (int64, error) {
+	n, err := c.File.ReadFrom(r)
+	c.count("write", n)
+	return n, err
+}
+
+func (c *countedFile) ReadFromAt(r io.Reader, off int64) (int64, error) {
+	n, err := c.File.ReadFromAt(r, off)
+	c.count("write", n)
+	return n, err
+}
@@ -0,0 +1,22 @@
+package nfs
+
+import (
+	"github.com/allape/dufs-broker/metrics"
+	"github.com/go-git/go-billy/v5"
+	nfshelper "github.com/willscott/go-nfs/helpers"
+)
+
+// countedCache counts the lookups of file handles in the cache, a client gets a stale handle for every miss
+type countedCache struct {
+	*nfshelper.CachingHandler
+}
+
+func (c *countedCache) FromHandle(fh []byte) (billy.Filesystem, []string, error) {
+	fs, path, err := c.CachingHandler.FromHandle(fh)
+	if err != nil {
+		metrics.NFSHandleLookups.Inc("miss")
+	} else {
+		metrics.NFSHandleLookups.Inc("hit")
+	}
+	return fs, path, err
+}
@@ -2,17 +2,19 @@ package nfs
 
 import (
 	"errors"
-	"github.com/allape/gohtvfs"
+	"github.com/allape/dufs-broker/vfs"
 	"github.com/go-git/go-billy/v5"
-	"io"
 	"net/url"
 	"os"
 	"strings"
+	"time"
 )
 
-func NewBillyDufs(dufs *gohtvfs.DufsVFS) billy.Filesystem {
+func NewBillyDufs(fs vfs.FS) billy.Filesystem {
 	return &BillyDufs{
-		dufs: dufs,
+		fs:      fs,
+		root:    "/",
+		uploads: newUploads(),
 	}
 }
 
@@ -20,34 +22,108 @@ var NotImplError = errors.New("not implemented")
 
 type BillyDufs struct {
 	billy.Filesystem
-	dufs *gohtvfs.DufsVFS
+	fs      vfs.FS
+	root    string
+	uploads *uploads // shared with every BillyDufs chrooted from this one
 }
 
 // region Basic
 
 func (d BillyDufs) Create(filename string) (billy.File, error) {
-	return d.Open(filename)
+	return d.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
 }
 
+// Open finishes the upload of filename if any, so what is read is what was written
 func (d BillyDufs) Open(filename string) (billy.File, error) {
-	file, err := d.dufs.Open(filename)
-	return &BillyDufsFile{file: file.(*gohtvfs.DufsFile)}, err
+	err := d.uploads.finish(d.path(filename))
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := d.fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &BillyDufsFile{file: file}, nil
 }
 
-func (d BillyDufs) OpenFile(filename string, _ int, _ os.FileMode) (billy.File, error) {
-	return d.Open(filename)
+// OpenFile for writing joins the upload of filename if any, or starts one
+func (d BillyDufs) OpenFile(filename string, flag int, _ os.FileMode) (billy.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return d.Open(filename)
+	}
+
+	path := d.path(filename)
+
+	if flag&(os.O_TRUNC|os.O_EXCL) != 0 {
+		err := d.uploads.finish(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	up, err := d.uploads.acquire(path, func() (vfs.File, error) {
+		return vfs.OpenFile(d.fs, filename, flag)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &uploadFile{
+		uploads: d.uploads,
+		upload:  up,
+		path:    path,
+	}, nil
 }
 
+// Stat reports the size of filename written so far if it is being uploaded,
+// and the error of its upload if it failed once idle
 func (d BillyDufs) Stat(filename string) (os.FileInfo, error) {
-	return d.dufs.Stat(filename)
+	path := d.path(filename)
+
+	err := d.uploads.err(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := d.fs.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if size, ok := d.uploads.size(path); ok && size > info.Size() {
+		return &sizedFileInfo{
+			FileInfo: info,
+			size:     size,
+		}, nil
+	}
+
+	return info, nil
 }
 
 func (d BillyDufs) Rename(oldpath, newpath string) error {
-	return d.dufs.Rename(oldpath, newpath)
+	err := errors.Join(d.uploads.finish(d.path(oldpath)), d.uploads.finish(d.path(newpath)))
+	if err != nil {
+		return err
+	}
+	return d.fs.Rename(oldpath, newpath)
 }
 
 func (d BillyDufs) Remove(filename string) error {
-	return d.dufs.Remove(filename)
+	err := d.uploads.finish(d.path(filename))
+	if err != nil {
+		return err
+	}
+	return d.fs.Remove(filename)
+}
+
+// path of filename from the root of the server, by which its upload is known
+func (d BillyDufs) path(filename string) string {
+	p, err := vfs.JailPath(d.root, filename)
+	if err != nil {
+		return filename // d.fs rejects it anyway
+	}
+	return p
 }
 
 func (d BillyDufs) Join(elem ...string) string {
@@ -75,23 +151,11 @@ func (d BillyDufs) TempFile(_, _ string) (billy.File, error) {
 // region Dir
 
 func (d BillyDufs) ReadDir(path string) ([]os.FileInfo, error) {
-	dirs, err := d.dufs.ReadDir(path)
-	if err != nil {
-		return nil, err
-	}
-	fileInfos := make([]os.FileInfo, len(dirs))
-	for i, dir := range dirs {
-		info, err := dir.Info()
-		if err != nil {
-			return nil, err
-		}
-		fileInfos[i] = info
-	}
-	return fileInfos, nil
+	return d.fs.ReadDir(path)
 }
 
 func (d BillyDufs) MkdirAll(filename string, perm os.FileMode) error {
-	return d.dufs.Mkdir(filename, perm)
+	return d.fs.Mkdir(filename, perm)
 }
 
 // endregion
@@ -99,7 +163,7 @@ func (d BillyDufs) MkdirAll(filename string, perm os.FileMode) error {
 // region Symlink
 
 func (d BillyDufs) Lstat(filename string) (os.FileInfo, error) {
-	return d.dufs.Stat(filename)
+	return d.Stat(filename)
 }
 
 func (d BillyDufs) Symlink(_, _ string) error {
@@ -112,25 +176,60 @@ func (d BillyDufs) Readlink(_ string) (string, error) {
 
 // endregion
 
+// region Change
+
+// Chmod is accepted but ignored, dufs has no notion of permissions
+func (d BillyDufs) Chmod(_ string, _ os.FileMode) error {
+	return nil
+}
+
+// Lchown is accepted but ignored, dufs has no notion of owners
+func (d BillyDufs) Lchown(_ string, _, _ int) error {
+	return nil
+}
+
+func (d BillyDufs) Chown(_ string, _, _ int) error {
+	return nil
+}
+
+// Chtimes finishes the upload of name first, which would change the modification time otherwise
+func (d BillyDufs) Chtimes(name string, _ time.Time, mtime time.Time) error {
+	err := d.uploads.finish(d.path(name))
+	if err != nil {
+		return err
+	}
+	return d.fs.Chtimes(name, mtime)
+}
+
+// endregion
+
 // region Chroot
 
-func (d BillyDufs) Chroot(_ string) (billy.Filesystem, error) {
-	return nil, NotImplError
+func (d BillyDufs) Chroot(path string) (billy.Filesystem, error) {
+	root, err := vfs.JailPath(d.root, path)
+	if err != nil {
+		return nil, billy.ErrCrossedBoundary
+	}
+	return &BillyDufs{
+		fs:      vfs.Chroot(d.fs, path),
+		root:    root,
+		uploads: d.uploads,
+	}, nil
 }
 
 func (d BillyDufs) Root() string {
-	return d.dufs.Root
+	return d.root
 }
 
 // endregion
 
 type BillyDufsFile struct {
 	billy.File
-	file *gohtvfs.DufsFile
+	file vfs.File
 }
 
 func (f *BillyDufsFile) Name() string {
-	return f.file.Name
+	return f.file.Name()
 }
 
 func (f *BillyDufsFile) Lock() error {
@@ -141,8 +240,8 @@ func (f *BillyDufsFile) Unlock() error {
 	return NotImplError
 }
 
-func (f *BillyDufsFile) Truncate(_ int64) error {
-	return NotImplError
+func (f *BillyDufsFile) Truncate(size int64) error {
+	return vfs.Truncate(f.file, size)
 }
 
 func (f *BillyDufsFile) Write(p []byte) (n int, err error) {
@@ -153,12 +252,9 @@ func (f *BillyDufsFile) Read(p []byte) (n int, err error) {
 	return f.file.Read(p)
 }
 
+// ReadAt gets only p, go-nfs opens the file for every READ
 func (f *BillyDufsFile) ReadAt(p []byte, off int64) (n int, err error) {
-	_, err = f.file.Seek(off, io.SeekStart)
-	if err != nil {
-		return 0, err
-	}
-	return f.file.Read(p)
+	return f.file.ReadAt(p, off)
 }
 
 func (f *BillyDufsFile) Seek(offset int64, whence int) (int64, error) {
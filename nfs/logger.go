@@ -0,0 +1,120 @@
+package nfs
+
+import (
+	"context"
+	"fmt"
+	"github.com/allape/dufs-broker/logging"
+	nfs2 "github.com/willscott/go-nfs"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+func init() {
+	nfs2.SetLogger(&logger{
+		logger: logging.New("go-nfs"),
+	})
+}
+
+// logger passes the logs of go-nfs to slog, whose level applies instead of the one of go-nfs
+type logger struct {
+	logger *slog.Logger
+}
+
+func (g *logger) log(level slog.Level, message string) {
+	g.logger.Log(context.Background(), level, strings.TrimSpace(message))
+}
+
+func (g *logger) SetLevel(_ nfs2.LogLevel) {}
+
+// GetLevel is the most verbose level of go-nfs that slog keeps
+func (g *logger) GetLevel() nfs2.LogLevel {
+	levels := []struct {
+		slog slog.Level
+		nfs  nfs2.LogLevel
+	}{
+		{logging.LevelVerbose, nfs2.TraceLevel},
+		{slog.LevelDebug, nfs2.DebugLevel},
+		{slog.LevelInfo, nfs2.InfoLevel},
+		{slog.LevelWarn, nfs2.WarnLevel},
+	}
+
+	for _, l := range levels {
+		if g.logger.Enabled(context.Background(), l.slog) {
+			return l.nfs
+		}
+	}
+	return nfs2.ErrorLevel
+}
+
+func (g *logger) ParseLevel(_ string) (nfs2.LogLevel, error) {
+	return nfs2.TraceLevel, nil
+}
+
+func (g *logger) Panic(args ...any) {
+	g.log(slog.LevelError, fmt.Sprint(args...))
+	panic(fmt.Sprint(args...))
+}
+
+func (g *logger) Fatal(args ...any) {
+	g.log(slog.LevelError, fmt.Sprint(args...))
+	os.Exit(1)
+}
+
+func (g *logger) Error(args ...any) {
+	g.log(slog.LevelError, fmt.Sprint(args...))
+}
+
+func (g *logger) Warn(args ...any) {
+	g.log(slog.LevelWarn, fmt.Sprint(args...))
+}
+
+func (g *logger) Info(args ...any) {
+	g.log(slog.LevelInfo, fmt.Sprint(args...))
+}
+
+func (g *logger) Debug(args ...any) {
+	g.log(slog.LevelDebug, fmt.Sprint(args...))
+}
+
+func (g *logger) Trace(args ...any) {
+	g.log(logging.LevelVerbose, fmt.Sprint(args...))
+}
+
+func (g *logger) Print(args ...any) {
+	g.log(slog.LevelInfo, fmt.Sprint(args...))
+}
+
+func (g *logger) Panicf(format string, args ...any) {
+	g.log(slog.LevelError, fmt.Sprintf(format, args...))
+	panic(fmt.Sprintf(format, args...))
+}
+
+func (g *logger) Fatalf(format string, args ...any) {
+	g.log(slog.LevelError, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+func (g *logger) Errorf(format string, args ...any) {
+	g.log(slog.LevelError, fmt.Sprintf(format, args...))
+}
+
+func (g *logger) Warnf(format string, args ...any) {
+	g.log(slog.LevelWarn, fmt.Sprintf(format, args...))
+}
+
+func (g *logger) Infof(format string, args ...any) {
+	g.log(slog.LevelInfo, fmt.Sprintf(format, args...))
+}
+
+func (g *logger) Debugf(format string, args ...any) {
+	g.log(slog.LevelDebug, fmt.Sprintf(format, args...))
+}
+
+func (g *logger) Tracef(format string, args ...any) {
+	g.log(logging.LevelVerbose, fmt.Sprintf(format, args...))
+}
+
+func (g *logger) Printf(format string, args ...any) {
+	g.log(slog.LevelInfo, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,37 @@
+package nfs
+
+import (
+	"github.com/allape/dufs-broker/logging"
+	nfs2 "github.com/willscott/go-nfs"
+	"testing"
+)
+
+func TestGetLevel(t *testing.T) {
+	cases := []struct {
+		level string
+		nfs   nfs2.LogLevel
+	}{
+		{"verbose", nfs2.TraceLevel},
+		{"debug", nfs2.DebugLevel},
+		{"info", nfs2.InfoLevel},
+		{"warn", nfs2.WarnLevel},
+		{"error", nfs2.ErrorLevel},
+		{"off", nfs2.ErrorLevel},
+	}
+
+	defer func() {
+		_ = logging.Init("info", "text")
+	}()
+
+	for _, c := range cases {
+		err := logging.Init(c.level, "text")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		level := nfs2.Log.GetLevel()
+		if level != c.nfs {
+			t.Errorf("Expected %d for %s but got %d", c.nfs, c.level, level)
+		}
+	}
+}
@@ -1,42 +1,92 @@
 package nfs
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/allape/dufs-broker/audit"
+	"github.com/allape/dufs-broker/auth"
+	"github.com/allape/dufs-broker/env"
 	"github.com/allape/dufs-broker/ipnet"
-	"github.com/allape/gogger"
-	"github.com/allape/gohtvfs"
+	"github.com/allape/dufs-broker/logging"
+	"github.com/allape/dufs-broker/metrics"
+	"github.com/allape/dufs-broker/session"
 	nfs2 "github.com/willscott/go-nfs"
 	nfshelper "github.com/willscott/go-nfs/helpers"
 	"net"
+	"time"
 )
 
-var l = gogger.New("nfs")
+var l = logging.New("nfs")
 
-func Start(addr string, dufs *gohtvfs.DufsVFS) error {
-	handler := nfshelper.NewNullAuthHandler(NewBillyDufs(dufs))
-	cacheHandler := nfshelper.NewCachingHandler(handler, 999)
+// offlineWait is how long an RPC is held while the dufs server is offline.
+// go-nfs has no way to answer NFS3ERR_JUKEBOX, which would tell the client to retry later,
+// so the RPC waits for the dufs server instead, and fails with an I/O error if it is not back in time.
+const offlineWait = 30 * time.Second
+
+// Server is every listener started by Start
+type Server struct {
+	registry *session.Registry
+}
+
+// Shutdown stops accepting clients, waits for the RPCs in flight until ctx is done, then disconnects every client
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.registry.Shutdown(ctx)
+}
+
+func Start(addr string, user *auth.User, builder *session.Builder) (*Server, error) {
+	server := &Server{
+		registry: session.NewRegistry("nfs", env.MaxConnections),
+	}
+
+	waiting := *builder
+	waiting.WaitOnline = offlineWait
+
+	// the files are shared by every connection, and go-nfs tells neither them nor its logger which connection
+	// a call is for, so requests to dufs and the go-nfs log lines carry no session ID
+	fs, err := waiting.FS(user, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	server.registry.SetUser(user.Name)
+
+	metrics.Sessions.Func(func() float64 {
+		return float64(server.registry.Connections())
+	}, "nfs")
+
+	fs = metrics.Count(fs, "nfs", user.Name)
+	// the READs of a file, like its WRITEs, are a single record until it is idle for uploadIdle
+	fs = audit.WrapShared(fs, "nfs", user.Name, user.Home, uploadIdle)
+
+	handler := nfshelper.NewNullAuthHandler(NewBillyDufs(server.registry.Track(fs)))
+	cacheHandler := &countedCache{
+		CachingHandler: nfshelper.NewCachingHandler(handler, 999).(*nfshelper.CachingHandler),
+	}
 
 	addrs, err := ipnet.DescriptAddress(addr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for _, addr := range addrs {
-		go start(addr, cacheHandler)
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			_ = server.Shutdown(context.Background())
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+
+		go serve(server.registry.Listener(listener), cacheHandler)
 	}
 
-	return nil
+	return server, nil
 }
 
-func start(addr string, handler nfs2.Handler) {
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		l.Error().Fatalf("Failed to listen: %v", err)
-	}
+func serve(listener net.Listener, handler nfs2.Handler) {
+	l.Info("NFS server started", "addr", listener.Addr())
 
-	l.Info().Printf("Server running at %s\n", listener.Addr())
-
-	err = nfs2.Serve(listener, handler)
-	if err != nil {
-		l.Error().Fatalf("Failed to serve NFS: %v", err)
+	err := nfs2.Serve(listener, handler)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		l.Error("Failed to serve NFS", "error", err)
 	}
 }
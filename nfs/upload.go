@@ -0,0 +1,263 @@
+package nfs
+
+import (
+	"errors"
+	"github.com/allape/dufs-broker/vfs"
+	"github.com/go-git/go-billy/v5"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// uploadIdle is how long a file is kept open for writing after its last WRITE.
+// go-nfs opens the file for every WRITE, keeping it open across them lets the writes be streamed to dufs in one upload.
+const uploadIdle = 3 * time.Second
+
+// uploads are the files open for writing, by their path from the root of the server
+type uploads struct {
+	idle   time.Duration // how long a file is kept open after its last WRITE, uploadIdle
+	locker sync.Mutex
+	open   map[string]*upload
+	failed map[string]error // of the uploads which failed once idle, until reported
+}
+
+func newUploads() *uploads {
+	return &uploads{
+		idle:   uploadIdle,
+		open:   map[string]*upload{},
+		failed: map[string]error{},
+	}
+}
+
+type upload struct {
+	file  vfs.File
+	size  int64       // end of the last byte written so far
+	users int         // RPCs holding the file
+	timer *time.Timer // closes the file once it is idle
+}
+
+// acquire returns the upload of path, opening it with open if there is none.
+// The file is opened without the lock, which would hold every other RPC up until dufs answers.
+func (u *uploads) acquire(path string, open func() (vfs.File, error)) (*upload, error) {
+	u.locker.Lock()
+	up, ok := u.open[path]
+	if ok {
+		u.hold(up)
+	}
+	u.locker.Unlock()
+
+	if ok {
+		return up, nil
+	}
+
+	file, err := open()
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.CachedStat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	u.locker.Lock()
+	up, ok = u.open[path]
+	if !ok {
+		up = &upload{
+			file: file,
+			size: stat.Size(),
+		}
+		u.open[path] = up
+	}
+	u.hold(up)
+	u.locker.Unlock()
+
+	// another RPC opened it meanwhile, whose upload is joined instead
+	if up.file != file {
+		_ = file.Close()
+	}
+
+	return up, nil
+}
+
+// hold keeps up open for one more RPC, it is called with the lock held
+func (u *uploads) hold(up *upload) {
+	if up.timer != nil {
+		up.timer.Stop()
+		up.timer = nil
+	}
+	up.users++
+}
+
+// release lets the upload of path be closed once it is idle
+func (u *uploads) release(path string, up *upload) {
+	u.locker.Lock()
+	defer u.locker.Unlock()
+
+	up.users--
+	if up.users > 0 {
+		return
+	}
+
+	up.timer = time.AfterFunc(u.idle, func() {
+		u.locker.Lock()
+		idle := u.open[path] == up && up.users == 0
+		if idle {
+			delete(u.open, path)
+		}
+		u.locker.Unlock()
+
+		if !idle {
+			return
+		}
+
+		err := up.file.Close()
+		if err != nil {
+			l.Error("Failed to upload", "path", path, "error", err)
+
+			u.locker.Lock()
+			u.failed[path] = err
+			u.locker.Unlock()
+		}
+	})
+}
+
+// finish closes the upload of path if it is idle, so the file is complete on dufs.
+// It returns the error of the upload, or of the one which failed once idle since the last report.
+func (u *uploads) finish(path string) error {
+	u.locker.Lock()
+	failed := u.report(path)
+	up, ok := u.open[path]
+	if !ok || up.users > 0 {
+		u.locker.Unlock()
+		return failed
+	}
+	up.timer.Stop()
+	delete(u.open, path)
+	u.locker.Unlock()
+
+	return errors.Join(failed, up.file.Close())
+}
+
+// err returns the error of the upload of path which failed once idle, if any, only once
+func (u *uploads) err(path string) error {
+	u.locker.Lock()
+	defer u.locker.Unlock()
+
+	return u.report(path)
+}
+
+// report is err with the lock held
+func (u *uploads) report(path string) error {
+	err := u.failed[path]
+	delete(u.failed, path)
+	return err
+}
+
+// size is the size of path written so far, if it is open for writing
+func (u *uploads) size(path string) (int64, bool) {
+	u.locker.Lock()
+	defer u.locker.Unlock()
+
+	up, ok := u.open[path]
+	if !ok {
+		return 0, false
+	}
+	return up.size, true
+}
+
+// uploadFile is the file of an upload, as opened by a single RPC
+type uploadFile struct {
+	billy.File
+	uploads *uploads
+	upload  *upload
+	path    string
+	offset  int64
+	closed  bool
+}
+
+func (f *uploadFile) Name() string {
+	return f.upload.file.Name()
+}
+
+func (f *uploadFile) Lock() error {
+	return NotImplError
+}
+
+func (f *uploadFile) Unlock() error {
+	return NotImplError
+}
+
+// Truncate is how go-nfs applies the size of SETATTR, such as 0 for "> file"
+func (f *uploadFile) Truncate(size int64) error {
+	err := vfs.Truncate(f.upload.file, size)
+	if err != nil {
+		return err
+	}
+
+	f.uploads.locker.Lock()
+	f.upload.size = size
+	f.uploads.locker.Unlock()
+
+	return nil
+}
+
+func (f *uploadFile) Read(_ []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *uploadFile) ReadAt(_ []byte, _ int64) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *uploadFile) Write(p []byte) (int, error) {
+	n, err := f.upload.file.WriteAt(p, f.offset)
+	f.offset += int64(n)
+
+	f.uploads.locker.Lock()
+	f.upload.size = max(f.upload.size, f.offset)
+	f.uploads.locker.Unlock()
+
+	return n, err
+}
+
+func (f *uploadFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		size, _ := f.uploads.size(f.path)
+		offset += size
+	default:
+		return 0, os.ErrInvalid
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	f.offset = offset
+
+	return offset, nil
+}
+
+func (f *uploadFile) Close() error {
+	if !f.closed {
+		f.closed = true
+		f.uploads.release(f.path, f.upload)
+	}
+	return nil
+}
+
+// sizedFileInfo is the FileInfo of a file being uploaded, with the size written so far
+type sizedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i *sizedFileInfo) Size() int64 {
+	return i.size
+}
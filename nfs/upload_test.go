@@ -0,0 +1,223 @@
+package nfs
+
+import (
+	"errors"
+	"github.com/allape/dufs-broker/vfs"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memFS keeps files in memory, and counts how often they are opened and closed
+type memFS struct {
+	vfs.FS
+	locker   sync.Mutex
+	files    map[string][]byte
+	opens    int
+	closes   int
+	closeErr error // of every Close, like an upload rejected by dufs
+}
+
+func (m *memFS) Open(name string) (vfs.File, error) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	m.opens++
+	return &memFile{
+		fs:   m,
+		name: name,
+	}, nil
+}
+
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	content, ok := m.files[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return &memInfo{
+		name: name,
+		size: int64(len(content)),
+	}, nil
+}
+
+func (m *memFS) counts() (int, int) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	return m.opens, m.closes
+}
+
+type memFile struct {
+	vfs.File
+	fs   *memFS
+	name string
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	return f.fs.Stat(f.name)
+}
+
+func (f *memFile) CachedStat() (fs.FileInfo, error) {
+	return f.fs.Stat(f.name)
+}
+
+// ReadFromAt patches the file, like a PATCH
+func (f *memFile) ReadFromAt(r io.Reader, off int64) (int64, error) {
+	p, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	f.fs.locker.Lock()
+	defer f.fs.locker.Unlock()
+
+	f.fs.files[f.name] = append(f.fs.files[f.name][:off], p...)
+	return int64(len(p)), nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.locker.Lock()
+	defer f.fs.locker.Unlock()
+
+	f.fs.closes++
+	return f.fs.closeErr
+}
+
+type memInfo struct {
+	fs.FileInfo
+	name string
+	size int64
+}
+
+func (i *memInfo) Name() string { return i.name }
+func (i *memInfo) Size() int64  { return i.size }
+func (i *memInfo) IsDir() bool  { return false }
+
+func newMemFS() *memFS {
+	return &memFS{
+		files: map[string][]byte{
+			"/a": []byte("ab"),
+		},
+	}
+}
+
+func TestUploadsJoin(t *testing.T) {
+	m := newMemFS()
+	u := newUploads()
+
+	open := func() (vfs.File, error) {
+		return m.Open("/a")
+	}
+
+	first, _ := u.acquire("/a", open)
+	second, _ := u.acquire("/a", open)
+	if first != second {
+		t.Errorf("Expected the upload to be joined but got %p and %p", first, second)
+	}
+
+	u.release("/a", first)
+	u.release("/a", second)
+
+	err := u.finish("/a")
+	if err != nil {
+		t.Errorf("Expected no error but got %v", err)
+	}
+
+	opens, closes := m.counts()
+	if opens != 1 || closes != 1 {
+		t.Errorf("Expected 1 open and 1 close but got %d and %d", opens, closes)
+	}
+}
+
+func TestUploadsIdle(t *testing.T) {
+	rejected := errors.New("413 Payload Too Large")
+
+	cases := []struct {
+		name   string
+		report func(d *BillyDufs) error // the first call after the upload failed once idle
+	}{
+		{"finish", func(d *BillyDufs) error { return d.uploads.finish("/a") }},
+		{"open", func(d *BillyDufs) error {
+			_, err := d.Open("/a")
+			return err
+		}},
+		{"stat", func(d *BillyDufs) error {
+			_, err := d.Stat("/a")
+			return err
+		}},
+	}
+
+	for _, c := range cases {
+		m := newMemFS()
+		m.closeErr = rejected
+
+		d := NewBillyDufs(m).(*BillyDufs)
+		d.uploads.idle = 10 * time.Millisecond
+
+		file, err := d.OpenFile("/a", os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		_ = file.Close()
+
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline) && !failed(d.uploads, "/a"); {
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		err = c.report(d)
+		if !errors.Is(err, rejected) {
+			t.Errorf("%s: Expected %v but got %v", c.name, rejected, err)
+		}
+
+		// it is reported once
+		_, err = d.Stat("/a")
+		if err != nil {
+			t.Errorf("%s: Expected no error but got %v", c.name, err)
+		}
+	}
+}
+
+// failed reports whether the upload of path failed once idle, without reporting it
+func failed(u *uploads, path string) bool {
+	u.locker.Lock()
+	defer u.locker.Unlock()
+
+	_, ok := u.failed[path]
+	return ok
+}
+
+func TestOpenFinishesUpload(t *testing.T) {
+	m := newMemFS()
+	d := NewBillyDufs(m)
+
+	file, err := d.OpenFile("/a", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, _ = file.Seek(0, io.SeekEnd)
+	_, _ = file.Write([]byte("c"))
+	_ = file.Close()
+
+	// the upload is idle, but not closed until it is read
+	if _, closes := m.counts(); closes != 0 {
+		t.Errorf("Expected the upload to be open but it was closed %d time(s)", closes)
+	}
+
+	_, err = d.Open("/a")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, closes := m.counts(); closes != 1 {
+		t.Errorf("Expected the upload to be closed once but got %d", closes)
+	}
+	if string(m.files["/a"]) != "abc" {
+		t.Errorf("Expected %q but got %q", "abc", m.files["/a"])
+	}
+}
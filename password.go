@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+	"os"
+	"strings"
+)
+
+// hashPassword prompts for a password on a terminal, or reads the first line of stdin otherwise
+func hashPassword(args []string) error {
+	flags := flag.NewFlagSet("hash-password", flag.ExitOnError)
+	cost := flags.Int("cost", bcrypt.DefaultCost, fmt.Sprintf("bcrypt cost, %d to %d", bcrypt.MinCost, bcrypt.MaxCost))
+	_ = flags.Parse(args)
+
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+
+	if password == "" {
+		return errors.New("empty password")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), *cost)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(hash))
+
+	return nil
+}
+
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	_, _ = fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(fd)
+	_, _ = fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	_, _ = fmt.Fprint(os.Stderr, "Repeat password: ")
+	repeated, err := term.ReadPassword(fd)
+	_, _ = fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	if string(password) != string(repeated) {
+		return "", errors.New("passwords do not match")
+	}
+
+	return string(password), nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/allape/dufs-broker/acl"
+	"github.com/allape/dufs-broker/admin"
+	"github.com/allape/dufs-broker/audit"
+	"github.com/allape/dufs-broker/auth"
+	"github.com/allape/dufs-broker/env"
+	"github.com/allape/dufs-broker/ftp"
+	"github.com/allape/dufs-broker/logging"
+	"github.com/allape/dufs-broker/metrics"
+	"github.com/allape/dufs-broker/nfs"
+	"github.com/allape/dufs-broker/session"
+	"github.com/allape/dufs-broker/sftp"
+	"github.com/allape/dufs-broker/upstream"
+	"github.com/allape/dufs-broker/vfs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// serve runs the broker until SIGINT or SIGTERM
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	env.RegisterFlags(flags)
+	_ = flags.Parse(args)
+
+	if flags.NArg() > 0 {
+		_ = os.Setenv(env.DubrokerDufsServer, flags.Arg(0))
+	}
+
+	file, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+
+	err = initLogger()
+	if err != nil {
+		return fmt.Errorf("failed to initialize logger: %w", err)
+	}
+
+	mounts, err := loadMounts(file)
+	if err != nil {
+		return err
+	}
+
+	if env.AuditLog != "" {
+		err = audit.Start(env.AuditLog, int64(env.AuditLogMaxSize)<<20, env.AuditLogBackups)
+		if err != nil {
+			return fmt.Errorf("failed to open audit log: %w", err)
+		}
+		defer func() {
+			_ = audit.Stop()
+		}()
+		l.Info("Audit log", "output", env.AuditLog)
+	}
+
+	mtimes, err := vfs.OpenMtimeStore(filepath.Join(env.StateDir, "mtimes.json"))
+	if err != nil {
+		return fmt.Errorf("failed to load modification times: %w", err)
+	}
+	defer func() {
+		_ = mtimes.Close()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sessionMounts := make([]session.Mount, len(mounts))
+	for i, m := range mounts {
+		l.Info("Dufs server", "url", env.Redact(m.upstream.URL), "mount", m.upstream.Mount)
+		for _, replica := range m.upstream.Replicas {
+			l.Info("Dufs replica", "url", env.Redact(replica))
+		}
+		if m.upstream.PinWrites {
+			l.Info("Writes are pinned", "url", env.Redact(m.upstream.URL))
+		}
+
+		err = m.factory.Verify(nil)
+		if err == nil || errors.Is(err, upstream.ErrUnauthorized) {
+			l.Info("Dufs server is online", "mount", m.upstream.Mount)
+		} else {
+			l.Warn("Dufs server is offline for now", "mount", m.upstream.Mount, "error", err)
+		}
+
+		go m.pool.Run(ctx, time.Duration(env.HealthCheckInterval)*time.Second)
+
+		for i, status := range m.pool.Status() {
+			metrics.UpstreamUp.Func(func() float64 {
+				return metrics.Bool(m.pool.Status()[i].Online)
+			}, status.URL)
+			metrics.UpstreamLatency.Func(func() float64 {
+				return m.pool.Status()[i].Latency.Seconds()
+			}, status.URL)
+		}
+
+		sessionMounts[i] = session.Mount{
+			Path:    m.upstream.Mount,
+			Factory: m.factory,
+			Pool:    m.pool,
+		}
+	}
+
+	users, loaded, err := loadAuthenticator(mounts, file)
+	if err != nil {
+		return fmt.Errorf("failed to load users: %w", err)
+	}
+	authenticator := auth.NewReloadable(loaded)
+
+	loadedPolicy, err := loadPolicy(file)
+	if err != nil {
+		return fmt.Errorf("failed to load ACL: %w", err)
+	}
+	policy := acl.NewReloadable(loadedPolicy)
+
+	builder := &session.Builder{
+		Mounts: sessionMounts,
+		Policy: policy,
+		Mtimes: mtimes,
+	}
+
+	servers := map[string]Server{}
+
+	if env.FTPEnabled {
+		var ftpAuthenticator auth.Authenticator = authenticator
+		if env.AnonymousEnabled {
+			ftpAuthenticator = &auth.Anonymous{
+				Authenticator: authenticator,
+				Home:          env.AnonymousRoot,
+			}
+		}
+
+		server, err := ftp.Start(env.FTPAddr, ftpAuthenticator, builder)
+		if err != nil {
+			return fmt.Errorf("failed to start FTP server: %w", err)
+		}
+		servers["FTP"] = server
+	}
+
+	if env.SFTPEnabled {
+		server, err := sftp.Start(env.SFTPAddr, authenticator, builder)
+		if err != nil {
+			return fmt.Errorf("failed to start SFTP server: %w", err)
+		}
+		servers["SFTP"] = server
+	}
+
+	if env.NFSEnabled {
+		nfsUser := &auth.User{
+			Name: env.NFSUser,
+		}
+		if users != nil {
+			if user, err := users.Lookup(env.NFSUser); err == nil {
+				nfsUser = user
+			}
+		}
+
+		server, err := nfs.Start(env.NFSAddr, nfsUser, builder)
+		if err != nil {
+			return fmt.Errorf("failed to start NFS server: %w", err)
+		}
+		servers["NFS"] = server
+	}
+
+	if env.MetricsAddr != "" {
+		server, err := metrics.Start(env.MetricsAddr)
+		if err != nil {
+			return fmt.Errorf("failed to start metrics server: %w", err)
+		}
+		servers["Metrics"] = server
+	}
+
+	var adminServer *admin.Server
+	if env.AdminAddr != "" {
+		adminServer, err = admin.Start(env.AdminAddr, env.AdminToken, effectiveConfig(mounts))
+		if err != nil {
+			return fmt.Errorf("failed to start admin API: %w", err)
+		}
+		servers["Admin"] = adminServer
+	}
+
+	if env.LogFormat == logging.FormatText {
+		_, _ = fmt.Fprint(os.Stderr, env.Banner)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			reload(mounts, authenticator, policy, adminServer)
+			continue
+		}
+		l.Info("Exiting", "signal", sig)
+		shutdown(servers)
+		return nil
+	}
+
+	return nil
+}
+
+type Server interface {
+	Shutdown(ctx context.Context) error
+}
+
+// shutdown stops every server at once, transfers in flight are given env.ShutdownTimeout to finish
+func shutdown(servers map[string]Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(env.ShutdownTimeout)*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for name, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := server.Shutdown(ctx)
+			if errors.Is(err, context.DeadlineExceeded) {
+				l.Warn("Transfers cut off", "server", name, "after", time.Duration(env.ShutdownTimeout)*time.Second)
+			} else if err != nil {
+				l.Error("Failed to shut down", "server", name, "error", err)
+			} else {
+				l.Info("Server stopped", "server", name)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// reload
+// Users, ACL, TLS certificate, trusted CAs, admin token and log level are replaced in place,
+// listeners and connected sessions are kept.
+// Nothing is replaced if the configuration is invalid, whatever fails to load keeps its previous value.
+// Listen addresses, dufs servers, anonymous login, the NFS user and the audit log take effect on restart only.
+func reload(mounts []*mount, authenticator *auth.Reloadable, policy *acl.Reloadable, adminServer *admin.Server) {
+	l.Info("Reloading configuration")
+
+	file, err := loadConfig()
+	if err != nil {
+		l.Error("Invalid configuration, nothing is reloaded", "error", err)
+		return
+	}
+
+	err = initLogger()
+	if err != nil {
+		l.Error("Failed to reload logger", "error", err)
+	}
+
+	_, loaded, err := loadAuthenticator(mounts, file)
+	if err != nil {
+		l.Error("Failed to reload users", "error", err)
+	} else {
+		authenticator.Set(loaded)
+	}
+
+	loadedPolicy, err := loadPolicy(file)
+	if err != nil {
+		l.Error("Failed to reload ACL", "error", err)
+	} else {
+		policy.Set(loadedPolicy)
+	}
+
+	for _, m := range mounts {
+		tlsConfig, err := loadTLSConfig(m.upstream)
+		if err != nil {
+			l.Error("Failed to reload trusted certs", "mount", m.upstream.Mount, "error", err)
+		} else {
+			m.transport.SetTLSConfig(tlsConfig)
+		}
+	}
+
+	if adminServer != nil {
+		adminServer.SetToken(env.AdminToken)
+	}
+
+	if env.FTPEnabled {
+		err = ftp.LoadCertificate()
+		if err != nil {
+			l.Error("Failed to reload TLS certificate", "error", err)
+		}
+	}
+
+	l.Info("Configuration reloaded")
+}
+
+// effectiveConfig is shown by the admin API, with the state of every dufs server
+func effectiveConfig(mounts []*mount) func() any {
+	type upstreamConfig struct {
+		Name      string                   `json:"name"`
+		Mount     string                   `json:"mount"`
+		PinWrites bool                     `json:"pin_writes"`
+		Replicas  []upstream.ReplicaStatus `json:"replicas"` // the primary first
+	}
+
+	return func() any {
+		upstreams := make([]upstreamConfig, len(mounts))
+		for i, m := range mounts {
+			upstreams[i] = upstreamConfig{
+				Name:      m.upstream.Name,
+				Mount:     m.upstream.Mount,
+				PinWrites: m.upstream.PinWrites,
+				Replicas:  m.pool.Status(),
+			}
+		}
+
+		return map[string]any{
+			"settings":  env.Effective(),
+			"upstreams": upstreams,
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package session
+
+import (
+	"fmt"
+	"github.com/allape/dufs-broker/vfs"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	registriesLocker sync.Mutex
+	registries       []*Registry // every registry created, for Sessions and Kick
+
+	lastID atomic.Uint64
+
+	bansLocker sync.Mutex
+	bans       = map[string]time.Time{} // IP to the end of its ban
+)
+
+// Session is a connection accepted by a Registry
+type Session struct {
+	id        uint64
+	registry  *Registry
+	conn      *trackedConn
+	connected time.Time
+	user      atomic.Pointer[string]
+	path      atomic.Pointer[string] // the last path the client visited
+}
+
+// newSession is called with the lock of registry held
+func newSession(registry *Registry, conn *trackedConn) *Session {
+	s := &Session{
+		id:        lastID.Add(1),
+		registry:  registry,
+		conn:      conn,
+		connected: time.Now(),
+	}
+	if registry.user != "" {
+		s.Login(registry.user)
+	}
+	return s
+}
+
+// ID is unique among the sessions of every protocol until restart
+func (s *Session) ID() uint64 {
+	return s.id
+}
+
+// Logger adds the ID, protocol, remote address and user of this session to every line of logger
+func (s *Session) Logger(logger *slog.Logger) *slog.Logger {
+	logger = logger.With("session", s.id, "protocol", s.registry.protocol, "remote_addr", s.conn.RemoteAddr().String())
+	if user := s.user.Load(); user != nil {
+		logger = logger.With("user", *user)
+	}
+	return logger
+}
+
+// Login names the user of this session
+func (s *Session) Login(user string) {
+	s.user.Store(&user)
+}
+
+// Track registers every file opened on fsys as a transfer of this session until it is closed
+func (s *Session) Track(fsys vfs.FS) vfs.FS {
+	return &trackedFS{
+		FS:       fsys,
+		registry: s.registry,
+		session:  s,
+	}
+}
+
+// Kick disconnects the client
+func (s *Session) Kick() error {
+	return s.conn.Close()
+}
+
+// Info is a snapshot of a session
+type Info struct {
+	ID         uint64     `json:"id"`
+	Protocol   string     `json:"protocol"`
+	User       string     `json:"user"` // empty until logged in
+	RemoteAddr string     `json:"remote_addr"`
+	Connected  time.Time  `json:"connected"`
+	Path       string     `json:"path"`
+	Transfers  []Transfer `json:"transfers"`
+}
+
+// Transfer is a file open in a session
+type Transfer struct {
+	Path    string    `json:"path"`
+	Started time.Time `json:"started"`
+	Read    int64     `json:"read"`    // bytes downloaded so far
+	Written int64     `json:"written"` // bytes uploaded so far
+}
+
+func (s *Session) Info() Info {
+	info := Info{
+		ID:         s.id,
+		Protocol:   s.registry.protocol,
+		RemoteAddr: s.conn.RemoteAddr().String(),
+		Connected:  s.connected,
+		Transfers:  s.registry.transfers(s),
+	}
+	if user := s.user.Load(); user != nil {
+		info.User = *user
+	}
+	if path := s.path.Load(); path != nil {
+		info.Path = *path
+	}
+	return info
+}
+
+// all is a snapshot of the sessions of every registry
+func all() []*Session {
+	registriesLocker.Lock()
+	snapshot := registries
+	registriesLocker.Unlock()
+
+	var sessions []*Session
+	for _, r := range snapshot {
+		sessions = append(sessions, r.sessions()...)
+	}
+	return sessions
+}
+
+// Sessions of every protocol, the oldest first
+func Sessions() []Info {
+	sessions := all()
+
+	infos := make([]Info, len(sessions))
+	for i, s := range sessions {
+		infos[i] = s.Info()
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+
+	return infos
+}
+
+// Kick disconnects the session of id, and reports whether there is one
+func Kick(id uint64) bool {
+	for _, s := range all() {
+		if s.id == id {
+			s.Logger(l).Info("Kicked")
+			_ = s.Kick()
+			return true
+		}
+	}
+	return false
+}
+
+// Ban rejects connections from ip for d, and disconnects its sessions.
+// It returns the end of the ban and the number of sessions disconnected.
+func Ban(ip string, d time.Duration) (time.Time, int, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return time.Time{}, 0, fmt.Errorf("invalid IP: %q", ip)
+	}
+	ip = parsed.String()
+
+	until := time.Now().Add(d)
+
+	bansLocker.Lock()
+	bans[ip] = until
+	bansLocker.Unlock()
+
+	l.Warn("Banned", "ip", ip, "until", until)
+
+	kicked := 0
+	for _, s := range all() {
+		if host(s.conn.RemoteAddr()) == ip {
+			_ = s.Kick()
+			kicked++
+		}
+	}
+
+	return until, kicked, nil
+}
+
+// Unban lifts the ban of ip, and reports whether there is one
+func Unban(ip string) bool {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		ip = parsed.String()
+	}
+
+	bansLocker.Lock()
+	defer bansLocker.Unlock()
+
+	_, ok := bans[ip]
+	delete(bans, ip)
+	return ok
+}
+
+// Bans are the IPs banned for now, with the end of their ban
+func Bans() map[string]time.Time {
+	bansLocker.Lock()
+	defer bansLocker.Unlock()
+
+	now := time.Now()
+	active := map[string]time.Time{}
+	for ip, until := range bans {
+		if until.After(now) {
+			active[ip] = until
+		} else {
+			delete(bans, ip)
+		}
+	}
+	return active
+}
+
+// Banned returns the end of the ban of the IP of addr, if it is banned
+func Banned(addr net.Addr) (time.Time, bool) {
+	bansLocker.Lock()
+	defer bansLocker.Unlock()
+
+	until, ok := bans[host(addr)]
+	if !ok || until.Before(time.Now()) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// host is the IP of addr
+func host(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	h, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return h
+}
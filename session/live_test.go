@@ -0,0 +1,95 @@
+package session
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	registry := NewRegistry("test", 0)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	listener = registry.Listener(listener)
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	accept := func() net.Conn {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = client.Close()
+		})
+
+		select {
+		case conn := <-accepted:
+			return conn
+		case <-time.After(100 * time.Millisecond):
+			return nil
+		}
+	}
+
+	conn := accept()
+	s := registry.Session(conn, nil)
+	if s == nil {
+		t.Fatalf("Expected a session but got nil")
+	}
+	s.Login("alice")
+
+	file, err := s.Track(&nopFS{}).Open("/a")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	info := s.Info()
+	if info.Protocol != "test" || info.User != "alice" || info.Path != "/a" || len(info.Transfers) != 1 {
+		t.Errorf("Expected a test session of alice at /a with a transfer but got %+v", info)
+	}
+
+	if registry.Session(nil, conn.RemoteAddr()) != s {
+		t.Errorf("Expected the session to be found by its remote address")
+	}
+
+	_, kicked, err := Ban("127.0.0.1", time.Minute)
+	if err != nil || kicked != 1 {
+		t.Errorf("Expected 1 session kicked but got %d, %v", kicked, err)
+	}
+
+	if registry.Connections() != 0 {
+		t.Errorf("Expected 0 connections but got %d", registry.Connections())
+	}
+
+	if conn = accept(); conn != nil {
+		t.Errorf("Expected the banned IP to be rejected but got a connection")
+	}
+
+	if !Unban("127.0.0.1") {
+		t.Errorf("Expected 127.0.0.1 to be banned")
+	}
+
+	if conn = accept(); conn == nil {
+		t.Errorf("Expected a connection after the ban is lifted but got nil")
+	} else if !Kick(registry.Session(conn, nil).id) {
+		t.Errorf("Expected the session to be kicked")
+	}
+}
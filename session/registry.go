@@ -0,0 +1,360 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"github.com/allape/dufs-broker/vfs"
+	"io"
+	"io/fs"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Registry keeps track of the connections of a server and the files opened in them,
+// an open file is a transfer in flight
+type Registry struct {
+	protocol       string
+	maxConnections int
+
+	locker    sync.Mutex
+	user      string // of every session, for protocols without login
+	listeners []net.Listener
+	conns     map[*trackedConn]struct{}
+	files     map[*trackedFile]chan struct{}
+}
+
+// NewRegistry creates a registry which turns away connections beyond maxConnections, unless it is 0
+func NewRegistry(protocol string, maxConnections int) *Registry {
+	r := &Registry{
+		protocol:       protocol,
+		maxConnections: maxConnections,
+		conns:          map[*trackedConn]struct{}{},
+		files:          map[*trackedFile]chan struct{}{},
+	}
+
+	registriesLocker.Lock()
+	registries = append(registries, r)
+	registriesLocker.Unlock()
+
+	return r
+}
+
+// SetUser names the user of every session, for protocols without login such as NFS
+func (r *Registry) SetUser(user string) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	r.user = user
+}
+
+// Listener registers every connection accepted by listener until it is closed
+func (r *Registry) Listener(listener net.Listener) net.Listener {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	r.listeners = append(r.listeners, listener)
+	return &trackedListener{
+		Listener: listener,
+		registry: r,
+	}
+}
+
+// Connections is the number of connections open
+func (r *Registry) Connections() int {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	return len(r.conns)
+}
+
+// Session of conn, which is accepted by a Listener, or of the connection from remoteAddr if conn is not one
+func (r *Registry) Session(conn net.Conn, remoteAddr net.Addr) *Session {
+	if tracked, ok := conn.(*trackedConn); ok {
+		return tracked.session
+	}
+
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	for tracked := range r.conns {
+		if remoteAddr != nil && tracked.RemoteAddr().String() == remoteAddr.String() {
+			return tracked.session
+		}
+	}
+
+	return nil
+}
+
+// Track registers every file opened on fsys until it is closed
+func (r *Registry) Track(fsys vfs.FS) vfs.FS {
+	return &trackedFS{
+		FS:       fsys,
+		registry: r,
+	}
+}
+
+// Shutdown stops accepting connections, waits for open files to be closed until ctx is done,
+// then closes every connection
+func (r *Registry) Shutdown(ctx context.Context) error {
+	r.locker.Lock()
+	listeners := r.listeners
+	r.listeners = nil
+	r.locker.Unlock()
+
+	var errs []error
+	for _, listener := range listeners {
+		err := listener.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+
+	errs = append(errs, r.drain(ctx))
+
+	for _, session := range r.sessions() {
+		_ = session.Kick()
+	}
+
+	return errors.Join(errs...)
+}
+
+// drain waits for the files open so far, then for those opened meanwhile, until none is left
+func (r *Registry) drain(ctx context.Context) error {
+	for {
+		r.locker.Lock()
+		closed := make([]chan struct{}, 0, len(r.files))
+		for _, c := range r.files {
+			closed = append(closed, c)
+		}
+		r.locker.Unlock()
+
+		if len(closed) == 0 {
+			return nil
+		}
+
+		l.Info("Waiting for transfers to finish", "protocol", r.protocol, "transfers", len(closed))
+
+		for _, c := range closed {
+			select {
+			case <-c:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// sessions is a snapshot of every session
+func (r *Registry) sessions() []*Session {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	sessions := make([]*Session, 0, len(r.conns))
+	for conn := range r.conns {
+		sessions = append(sessions, conn.session)
+	}
+	return sessions
+}
+
+// transfers is a snapshot of the files open in session, or of every file if session is nil
+func (r *Registry) transfers(session *Session) []Transfer {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+
+	transfers := []Transfer{}
+	for file := range r.files {
+		if session == nil || file.session == session {
+			transfers = append(transfers, file.transfer())
+		}
+	}
+	return transfers
+}
+
+type trackedListener struct {
+	net.Listener
+	registry *Registry
+}
+
+func (t *trackedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := t.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if until, ok := Banned(conn.RemoteAddr()); ok {
+			l.Warn("Rejected a banned IP", "protocol", t.registry.protocol, "remote_addr", conn.RemoteAddr(), "until", until)
+			_ = conn.Close()
+			continue
+		}
+
+		tracked := &trackedConn{
+			Conn:     conn,
+			registry: t.registry,
+		}
+
+		t.registry.locker.Lock()
+		full := t.registry.maxConnections > 0 && len(t.registry.conns) >= t.registry.maxConnections
+		if !full {
+			tracked.session = newSession(t.registry, tracked)
+			t.registry.conns[tracked] = struct{}{}
+		}
+		t.registry.locker.Unlock()
+
+		if full {
+			l.Warn("Too many connections, rejected", "protocol", t.registry.protocol, "remote_addr", conn.RemoteAddr())
+			_ = conn.Close()
+			continue
+		}
+
+		tracked.session.Logger(l).Debug("Connected")
+
+		return tracked, nil
+	}
+}
+
+type trackedConn struct {
+	net.Conn
+	registry *Registry
+	session  *Session
+}
+
+func (t *trackedConn) Close() error {
+	t.registry.locker.Lock()
+	_, open := t.registry.conns[t]
+	delete(t.registry.conns, t)
+	t.registry.locker.Unlock()
+
+	if open {
+		t.session.Logger(l).Debug("Disconnected", "duration", time.Since(t.session.connected))
+	}
+
+	return t.Conn.Close()
+}
+
+type trackedFS struct {
+	vfs.FS
+	registry *Registry
+	session  *Session // nil if the files are not opened by a single session
+}
+
+// visit records name as the current path of the session
+func (t *trackedFS) visit(name string) {
+	if t.session != nil {
+		t.session.path.Store(&name)
+	}
+}
+
+func (t *trackedFS) Open(name string) (vfs.File, error) {
+	t.visit(name)
+
+	file, err := t.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	tracked := &trackedFile{
+		File:     file,
+		registry: t.registry,
+		session:  t.session,
+		name:     name,
+		started:  time.Now(),
+	}
+
+	t.registry.locker.Lock()
+	t.registry.files[tracked] = make(chan struct{})
+	t.registry.locker.Unlock()
+
+	return tracked, nil
+}
+
+func (t *trackedFS) Stat(name string) (fs.FileInfo, error) {
+	t.visit(name)
+	return t.FS.Stat(name)
+}
+
+func (t *trackedFS) ReadDir(name string) ([]fs.FileInfo, error) {
+	t.visit(name)
+	return t.FS.ReadDir(name)
+}
+
+type trackedFile struct {
+	vfs.File
+	registry *Registry
+	session  *Session
+	name     string
+	started  time.Time
+	read     atomic.Int64
+	written  atomic.Int64
+}
+
+func (t *trackedFile) transfer() Transfer {
+	return Transfer{
+		Path:    t.name,
+		Started: t.started,
+		Read:    t.read.Load(),
+		Written: t.written.Load(),
+	}
+}
+
+func (t *trackedFile) Read(p []byte) (int, error) {
+	n, err := t.File.Read(p)
+	t.read.Add(int64(n))
+	return n, err
+}
+
+func (t *trackedFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := t.File.ReadAt(p, off)
+	t.read.Add(int64(n))
+	return n, err
+}
+
+func (t *trackedFile) Write(p []byte) (int, error) {
+	n, err := t.File.Write(p)
+	t.written.Add(int64(n))
+	return n, err
+}
+
+func (t *trackedFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := t.File.WriteAt(p, off)
+	t.written.Add(int64(n))
+	return n, err
+}
+
+// ReadFrom counts the bytes of an upload as they are read, instead of once it is done
+func (t *trackedFile) ReadFrom(r io.Reader) (int64, error) {
+	return t.File.ReadFrom(&progress{
+		Reader:  r,
+		written: &t.written,
+	})
+}
+
+func (t *trackedFile) ReadFromAt(r io.Reader, off int64) (int64, error) {
+	return t.File.ReadFromAt(&progress{
+		Reader:  r,
+		written: &t.written,
+	}, off)
+}
+
+func (t *trackedFile) Close() error {
+	err := t.File.Close()
+
+	t.registry.locker.Lock()
+	if closed, ok := t.registry.files[t]; ok {
+		close(closed)
+		delete(t.registry.files, t)
+	}
+	t.registry.locker.Unlock()
+
+	return err
+}
+
+type progress struct {
+	io.Reader
+	written *atomic.Int64
+}
+
+func (p *progress) Read(b []byte) (int, error) {
+	n, err := p.Reader.Read(b)
+	p.written.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,90 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"github.com/allape/dufs-broker/vfs"
+	"net"
+	"testing"
+	"time"
+)
+
+type nopFile struct {
+	vfs.File
+}
+
+func (f *nopFile) Close() error {
+	return nil
+}
+
+type nopFS struct {
+	vfs.FS
+}
+
+func (f *nopFS) Open(_ string) (vfs.File, error) {
+	return &nopFile{}, nil
+}
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry("test", 0)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	listener = registry.Listener(listener)
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+	<-accepted
+
+	fsys := registry.Track(&nopFS{})
+	file, err := fsys.Open("/a")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = file.Close()
+	}()
+
+	err = registry.Shutdown(context.Background())
+	if err != nil {
+		t.Errorf("Expected nil but got %v", err)
+	}
+
+	_, err = client.Read(make([]byte, 1))
+	if err == nil {
+		t.Errorf("Expected the connection to be closed but got nil")
+	}
+
+	_, err = net.Dial("tcp", listener.Addr().String())
+	if err == nil {
+		t.Errorf("Expected the listener to be closed but got nil")
+	}
+
+	_, err = fsys.Open("/b")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err = registry.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected %v but got %v", context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,120 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"github.com/allape/dufs-broker/acl"
+	"github.com/allape/dufs-broker/auth"
+	"github.com/allape/dufs-broker/logging"
+	"github.com/allape/dufs-broker/upstream"
+	"github.com/allape/dufs-broker/vfs"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+var (
+	l          = logging.New("session")
+	dufsLogger = logging.New("dufs")
+)
+
+// Mount is a dufs server shown at Path, / for the only one
+type Mount struct {
+	Path    string
+	Factory *upstream.Factory
+	Pool    *upstream.Pool // the replicas of the dufs server, which are always online if nil
+}
+
+// Builder puts together the filesystem each protocol session works on
+type Builder struct {
+	Mounts []Mount
+	Policy acl.Checker
+	// WaitOnline is how long an operation on an offline dufs server waits for it to come back before failing,
+	// it fails at once if 0
+	WaitOnline time.Duration
+	// Mtimes keeps the modification times clients set, they can not be set if nil
+	Mtimes *vfs.MtimeStore
+}
+
+// Online reports whether any dufs server is online
+func (b *Builder) Online() bool {
+	for _, mount := range b.Mounts {
+		if mount.Pool == nil || mount.Pool.Online() {
+			return true
+		}
+	}
+	return false
+}
+
+// FS creates the filesystem for session, which is logged in as user.
+// The requests it sends to dufs carry the ID of session, unless it is nil.
+func (b *Builder) FS(user *auth.User, session *Session) (vfs.FS, error) {
+	fsys, err := b.mount(user, session)
+	if err != nil {
+		return nil, err
+	}
+
+	fsys = vfs.WithPolicy(fsys, b.Policy, user.Name)
+
+	if user.Anonymous {
+		fsys = vfs.WithPolicy(fsys, acl.ReadOnly, user.Name)
+	}
+
+	return vfs.Chroot(fsys, user.Home), nil
+}
+
+// mount returns the only dufs server mounted at /, or the union of every mount
+func (b *Builder) mount(user *auth.User, session *Session) (vfs.FS, error) {
+	mounts := make([]vfs.Mount, len(b.Mounts))
+
+	for i, mount := range b.Mounts {
+		dufs, err := mount.Factory.New(user.Userinfo(mount.Path))
+		if err != nil {
+			return nil, err
+		}
+		if session != nil {
+			dufs.HttpClient.Transport = upstream.WithSession(dufs.HttpClient.Transport, strconv.FormatUint(session.id, 10))
+			dufs.SetLogger(slog.NewLogLogger(session.Logger(dufsLogger).Handler(), slog.LevelDebug))
+		}
+
+		var fsys vfs.FS = vfs.NewDufs(dufs)
+		if b.WaitOnline > 0 && mount.Pool != nil {
+			fsys = vfs.Waiting(fsys, b.waiter(mount.Pool))
+		}
+		if b.Mtimes != nil {
+			root := mount.Factory.Root()
+			root.User = nil
+			fsys = vfs.WithMtimes(fsys, b.Mtimes, root.String())
+		}
+
+		if acl.Clean(mount.Path) == "/" {
+			if len(b.Mounts) > 1 {
+				return nil, errors.New("a dufs server mounted at / can not be mounted with others")
+			}
+			return fsys, nil
+		}
+
+		mounts[i] = vfs.Mount{
+			Path: mount.Path,
+			FS:   fsys,
+		}
+	}
+
+	return vfs.Union(mounts)
+}
+
+// waiter waits up to WaitOnline for pool to be online
+func (b *Builder) waiter(pool *upstream.Pool) func() error {
+	return func() error {
+		if pool.Online() {
+			return nil
+		}
+
+		l.Debug("Waiting for the dufs server to come back")
+
+		ctx, cancel := context.WithTimeout(context.Background(), b.WaitOnline)
+		defer cancel()
+
+		return pool.Wait(ctx)
+	}
+}
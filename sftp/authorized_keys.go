@@ -0,0 +1,118 @@
+package sftp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ParseAuthorizedKeys parses an OpenSSH authorized_keys file.
+// The comment of each key is the username it belongs to, keys without a comment are skipped.
+func ParseAuthorizedKeys(data []byte) (map[string]string, error) {
+	keys := map[string]string{}
+
+	for lineNumber := 1; len(bytes.TrimSpace(data)) > 0; lineNumber++ {
+		var line []byte
+		line, data, _ = bytes.Cut(data, []byte("\n"))
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		key, comment, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		username := strings.TrimSpace(comment)
+		if username == "" {
+			l.Warn("Authorized key has no username in its comment, skipped", "line", lineNumber)
+			continue
+		}
+
+		keys[string(key.Marshal())] = username
+	}
+
+	return keys, nil
+}
+
+// AuthorizedKeys reloads the file whenever its size or modification time changes
+type AuthorizedKeys struct {
+	path    string
+	locker  sync.Mutex
+	size    int64
+	modTime time.Time
+	keys    map[string]string
+}
+
+func NewAuthorizedKeys(path string) (*AuthorizedKeys, error) {
+	keys := &AuthorizedKeys{
+		path: path,
+	}
+	return keys, keys.reload()
+}
+
+func (k *AuthorizedKeys) reload() error {
+	stat, err := os.Stat(k.path)
+	if err != nil {
+		k.revoke(err)
+		return err
+	}
+
+	if k.keys != nil && stat.Size() == k.size && stat.ModTime().Equal(k.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		k.revoke(err)
+		return err
+	}
+
+	keys, err := ParseAuthorizedKeys(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", k.path, err)
+	}
+
+	k.keys = keys
+	k.size = stat.Size()
+	k.modTime = stat.ModTime()
+
+	l.Info("Loaded authorized keys", "count", len(keys), "path", k.path)
+
+	return nil
+}
+
+// revoke drops every key once the file is deleted, other errors keep the last good keys
+func (k *AuthorizedKeys) revoke(err error) {
+	if !errors.Is(err, fs.ErrNotExist) || k.keys == nil {
+		return
+	}
+
+	k.keys = nil
+	k.size = 0
+	k.modTime = time.Time{}
+
+	l.Warn("Authorized keys file is gone, every key is revoked", "path", k.path)
+}
+
+// Lookup returns the username that key belongs to
+func (k *AuthorizedKeys) Lookup(key ssh.PublicKey) (string, bool) {
+	k.locker.Lock()
+	defer k.locker.Unlock()
+
+	err := k.reload()
+	if err != nil {
+		l.Error("Failed to reload authorized keys", "error", err)
+	}
+
+	username, ok := k.keys[string(key.Marshal())]
+	return username, ok
+}
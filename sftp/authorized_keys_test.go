@@ -0,0 +1,91 @@
+package sftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newPublicKey(t *testing.T) ssh.PublicKey {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func authorizedKeyLine(key ssh.PublicKey, comment string) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) + " " + comment
+}
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	alice := newPublicKey(t)
+	bob := newPublicKey(t)
+	nobody := newPublicKey(t)
+
+	data := strings.Join([]string{
+		"# comment",
+		"",
+		authorizedKeyLine(alice, "alice"),
+		`no-pty ` + authorizedKeyLine(bob, "bob"),
+		authorizedKeyLine(nobody, ""),
+	}, "\n")
+
+	keys, err := ParseAuthorizedKeys([]byte(data))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(keys) != 2 {
+		t.Errorf("Expected 2 keys but got %d", len(keys))
+	}
+
+	if username := keys[string(alice.Marshal())]; username != "alice" {
+		t.Errorf("Expected alice but got %q", username)
+	}
+
+	if username := keys[string(bob.Marshal())]; username != "bob" {
+		t.Errorf("Expected bob but got %q", username)
+	}
+
+	_, err = ParseAuthorizedKeys([]byte("ssh-ed25519 not-base64 alice"))
+	if err == nil {
+		t.Errorf("Expected error but got nil")
+	}
+}
+
+func TestAuthorizedKeysDeleted(t *testing.T) {
+	alice := newPublicKey(t)
+
+	path := filepath.Join(t.TempDir(), "authorized_keys")
+	err := os.WriteFile(path, []byte(authorizedKeyLine(alice, "alice")), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := NewAuthorizedKeys(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if username, ok := keys.Lookup(alice); !ok || username != "alice" {
+		t.Errorf("Expected alice but got %q", username)
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if username, ok := keys.Lookup(alice); ok {
+		t.Errorf("Expected no user once the file is deleted but got %q", username)
+	}
+}
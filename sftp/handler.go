@@ -0,0 +1,363 @@
+package sftp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/allape/dufs-broker/vfs"
+	"github.com/pkg/sftp"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+func NewDufsHandlers(fsys vfs.FS) sftp.Handlers {
+	handler := &DufsHandler{
+		fs: fsys,
+	}
+	return sftp.Handlers{
+		FileGet:  handler,
+		FilePut:  handler,
+		FileCmd:  handler,
+		FileList: handler,
+	}
+}
+
+type DufsHandler struct {
+	fs vfs.FS
+}
+
+func (h *DufsHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	file, err := h.fs.Open(r.Filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err == nil && stat.IsDir() {
+		err = os.ErrInvalid
+	}
+	if err != nil {
+		// an open file is a transfer in flight until it is closed
+		_ = file.Close()
+		return nil, err
+	}
+
+	return &DufsReaderAt{
+		file: file,
+	}, nil
+}
+
+func (h *DufsHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	flag := os.O_WRONLY
+	pflags := r.Pflags()
+	if pflags.Append {
+		flag |= os.O_APPEND
+	}
+	if pflags.Creat {
+		flag |= os.O_CREATE
+	}
+	if pflags.Excl {
+		flag |= os.O_EXCL
+	}
+	if pflags.Trunc {
+		flag |= os.O_TRUNC
+	}
+
+	file, err := vfs.OpenFile(h.fs, r.Filepath, flag)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.CachedStat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return &DufsWriterAt{
+		file:      file,
+		size:      stat.Size(),
+		append:    pflags.Append,
+		appending: pflags.Append,
+		pending:   map[int64][]byte{},
+	}, nil
+}
+
+func (h *DufsHandler) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		return h.setstat(r)
+	case "Rename", "PosixRename":
+		return h.fs.Rename(r.Filepath, r.Target)
+	case "Rmdir", "Remove":
+		return h.fs.Remove(r.Filepath)
+	case "Mkdir":
+		return h.fs.Mkdir(r.Filepath, os.ModePerm)
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// setstat changes the size and the modification time of a file, for SETSTAT and FSETSTAT.
+// dufs has no notion of permissions or owners, a change to them is reported as unsupported
+// once the others are made, so the client is never told a change was made when it was not.
+func (h *DufsHandler) setstat(r *sftp.Request) error {
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+
+	if flags.Size {
+		err := h.truncate(r.Filepath, int64(attrs.Size))
+		if err != nil {
+			return err
+		}
+	}
+
+	if flags.Acmodtime {
+		err := h.fs.Chtimes(r.Filepath, time.Unix(int64(attrs.Mtime), 0))
+		if err != nil {
+			return err
+		}
+	}
+
+	if flags.Permissions || flags.UidGid {
+		return sftp.ErrSSHFxOpUnsupported
+	}
+
+	return nil
+}
+
+// truncate changes the size of name, such as an editor emptying a file before saving it
+func (h *DufsHandler) truncate(name string, size int64) error {
+	file, err := vfs.OpenFile(h.fs, name, os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+
+	err = vfs.Truncate(file, size)
+	if err != nil {
+		return errors.Join(err, vfs.Abort(file, err))
+	}
+
+	return file.Close()
+}
+
+func (h *DufsHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		entries, err := h.fs.ReadDir(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		fileInfos := make([]os.FileInfo, len(entries))
+		for i, entry := range entries {
+			fileInfos[i] = &DufsFileInfo{
+				fileInfo: entry,
+			}
+		}
+		return ListerAt(fileInfos), nil
+	case "Stat":
+		stat, err := h.fs.Stat(r.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		return ListerAt{
+			&DufsFileInfo{
+				fileInfo: stat,
+			},
+		}, nil
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+type ListerAt []os.FileInfo
+
+func (l ListerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// DufsReaderAt serializes reads, DufsFile.ReadAt moves the shared file index
+type DufsReaderAt struct {
+	locker sync.Mutex
+	file   vfs.File
+}
+
+func (r *DufsReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	return r.file.ReadAt(p, off)
+}
+
+func (r *DufsReaderAt) Close() error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	return r.file.Close()
+}
+
+// maxPending is how many bytes of chunks beyond the end of a file DufsWriterAt holds in memory
+const maxPending = 8 << 20
+
+// DufsWriterAt
+// SFTP clients pipeline their writes, so chunks may arrive out of order.
+// Chunks beyond the current end of the file are held until the gap is filled,
+// so the file can be streamed to dufs. Past maxPending, they are written to the file as they come,
+// which spills it to a temporary file.
+// Chunks of an append are held the same way, as every write goes to the end of the file.
+type DufsWriterAt struct {
+	locker      sync.Mutex
+	file        vfs.File
+	size        int64
+	base        int64 // added to the offsets of the client
+	append      bool  // opened with SSH_FXF_APPEND
+	appending   bool  // the offsets of the append are not known yet to start from 0 or from the end of the file
+	pending     map[int64][]byte
+	pendingSize int64
+}
+
+var errOutOfOrder = errors.New("chunks of the append too far out of order")
+
+func (w *DufsWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	w.locker.Lock()
+	defer w.locker.Unlock()
+
+	if w.appending {
+		if off != 0 && off != w.size {
+			return w.hold(p, off)
+		}
+		w.start(off)
+	}
+	off += w.base
+
+	if off > w.size {
+		if w.pendingSize+int64(len(p)) <= maxPending || w.append {
+			return w.hold(p, off)
+		}
+
+		// too far out of order to hold, every chunk is written at its offset
+		for chunkOff, chunk := range w.pending {
+			err := w.write(chunk, chunkOff)
+			if err != nil {
+				return 0, err
+			}
+		}
+		clear(w.pending)
+		w.pendingSize = 0
+	}
+
+	err := w.write(p, off)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		chunk, ok := w.pending[w.size]
+		if !ok {
+			break
+		}
+		delete(w.pending, w.size)
+		w.pendingSize -= int64(len(chunk))
+		err = w.write(chunk, w.size)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// hold keeps p until the chunks before it are written, an append can not be written out of order
+func (w *DufsWriterAt) hold(p []byte, off int64) (int, error) {
+	if w.append && w.pendingSize+int64(len(p)) > maxPending {
+		return 0, errOutOfOrder
+	}
+	w.pending[off] = bytes.Clone(p)
+	w.pendingSize += int64(len(p))
+	return len(p), nil
+}
+
+// start takes the offsets of the append from where the client writes first:
+// 0 is the start of the append, as the pkg/sftp client writes,
+// and the end of the file is the end of the file, as OpenSSH resumes an upload.
+func (w *DufsWriterAt) start(off int64) {
+	w.appending = false
+	if off == 0 {
+		w.base = w.size
+	}
+
+	pending := make(map[int64][]byte, len(w.pending))
+	for chunkOff, chunk := range w.pending {
+		pending[chunkOff+w.base] = chunk
+	}
+	w.pending = pending
+}
+
+func (w *DufsWriterAt) write(p []byte, off int64) error {
+	_, err := w.file.WriteAt(p, off)
+	if err != nil {
+		return err
+	}
+
+	w.size = max(w.size, off+int64(len(p)))
+
+	return nil
+}
+
+func (w *DufsWriterAt) Close() error {
+	w.locker.Lock()
+	defer w.locker.Unlock()
+
+	// the upload is cut off rather than finished, so dufs does not keep it as if it were complete
+	if len(w.pending) > 0 {
+		err := fmt.Errorf("incomplete upload: missing data at offset %d", w.size)
+		return errors.Join(err, vfs.Abort(w.file, err))
+	}
+
+	return w.file.Close()
+}
+
+type DufsFileInfo struct {
+	os.FileInfo
+	fileInfo os.FileInfo
+}
+
+func (i *DufsFileInfo) Name() string {
+	return path.Base(i.fileInfo.Name())
+}
+
+func (i *DufsFileInfo) Size() int64 {
+	if i.fileInfo.IsDir() {
+		return 0
+	}
+	return i.fileInfo.Size()
+}
+
+func (i *DufsFileInfo) Mode() os.FileMode {
+	if i.fileInfo.IsDir() {
+		return i.fileInfo.Mode() | os.ModeDir
+	}
+	return i.fileInfo.Mode()
+}
+
+func (i *DufsFileInfo) ModTime() time.Time {
+	return i.fileInfo.ModTime()
+}
+
+func (i *DufsFileInfo) IsDir() bool {
+	return i.fileInfo.IsDir()
+}
+
+func (i *DufsFileInfo) Sys() any {
+	return nil
+}
@@ -0,0 +1,490 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/allape/dufs-broker/vfs"
+	"github.com/pkg/sftp"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memFS keeps files in memory, and answers like DufsVFS does
+type memFS struct {
+	vfs.FS
+	locker sync.Mutex
+	files  map[string][]byte
+	dirs   map[string]bool
+	mtimes map[string]time.Time
+}
+
+func newMemFS(files map[string]string) *memFS {
+	m := &memFS{
+		files:  map[string][]byte{},
+		dirs:   map[string]bool{"/": true},
+		mtimes: map[string]time.Time{},
+	}
+	for name, content := range files {
+		m.files[name] = []byte(content)
+	}
+	return m
+}
+
+func (m *memFS) content(name string) (string, bool) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	content, ok := m.files[name]
+	return string(content), ok
+}
+
+func (m *memFS) Open(name string) (vfs.File, error) {
+	return &memFile{
+		fs:   m,
+		name: name,
+	}, nil
+}
+
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	if m.dirs[name] {
+		return &memInfo{
+			name: name,
+			dir:  true,
+		}, nil
+	}
+
+	content, ok := m.files[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return &memInfo{
+		name: name,
+		size: int64(len(content)),
+	}, nil
+}
+
+func (m *memFS) ReadDir(name string) ([]fs.FileInfo, error) {
+	var names []string
+	m.locker.Lock()
+	for file := range m.files {
+		if path.Dir(file) == name {
+			names = append(names, file)
+		}
+	}
+	m.locker.Unlock()
+	sort.Strings(names)
+
+	fileInfos := make([]fs.FileInfo, len(names))
+	for i, file := range names {
+		fileInfos[i], _ = m.Stat(file)
+	}
+	return fileInfos, nil
+}
+
+func (m *memFS) Mkdir(name string, _ fs.FileMode) error {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	m.dirs[name] = true
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	if _, ok := m.files[name]; !ok && !m.dirs[name] {
+		return fs.ErrNotExist
+	}
+	delete(m.files, name)
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *memFS) Rename(oldname, newname string) error {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	content, ok := m.files[oldname]
+	if !ok {
+		return fs.ErrNotExist
+	}
+	m.files[newname] = content
+	delete(m.files, oldname)
+	return nil
+}
+
+func (m *memFS) Chtimes(name string, mtime time.Time) error {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+
+	m.mtimes[name] = mtime
+	return nil
+}
+
+type memFile struct {
+	vfs.File
+	fs     *memFS
+	name   string
+	offset int64
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	return f.fs.Stat(f.name)
+}
+
+func (f *memFile) CachedStat() (fs.FileInfo, error) {
+	return f.fs.Stat(f.name)
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) Seek(offset int64, _ int) (int64, error) {
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	content, _ := f.fs.content(f.name)
+	if off >= int64(len(content)) {
+		return 0, io.EOF
+	}
+	return copy(p, content[off:]), nil
+}
+
+// ReadFrom replaces the file, like a PUT, which fails if its body is cut off
+func (f *memFile) ReadFrom(r io.Reader) (int64, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(content)), err
+	}
+
+	f.fs.locker.Lock()
+	defer f.fs.locker.Unlock()
+
+	f.fs.files[f.name] = content
+	return int64(len(content)), nil
+}
+
+// ReadFromAt patches the file, like a PATCH
+func (f *memFile) ReadFromAt(r io.Reader, off int64) (int64, error) {
+	p, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	f.fs.locker.Lock()
+	defer f.fs.locker.Unlock()
+
+	content := f.fs.files[f.name]
+	if off > int64(len(content)) {
+		return 0, fs.ErrInvalid
+	}
+	tail := content[min(off+int64(len(p)), int64(len(content))):]
+	f.fs.files[f.name] = append(append(content[:off:off], p...), tail...)
+	return int64(len(p)), nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+type memInfo struct {
+	fs.FileInfo
+	name string
+	size int64
+	dir  bool
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) IsDir() bool        { return i.dir }
+func (i *memInfo) Mode() fs.FileMode  { return 0o644 }
+func (i *memInfo) ModTime() time.Time { return time.Time{} }
+
+// the flags of SETSTAT attributes, as in draft-ietf-secsh-filexfer-02
+const (
+	attrSize        = 0x1
+	attrPermissions = 0x4
+	attrTimes       = 0x8
+)
+
+func TestSetstat(t *testing.T) {
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	cases := []struct {
+		name    string
+		flags   uint32
+		attrs   []byte
+		content string // of /a, which is "hello" at first
+		mtime   time.Time
+		err     error
+	}{
+		{"empty", attrSize, binary.BigEndian.AppendUint64(nil, 0), "", time.Time{}, nil},
+		{"shrink", attrSize, binary.BigEndian.AppendUint64(nil, 2), "he", time.Time{}, nil},
+		{"grow", attrSize, binary.BigEndian.AppendUint64(nil, 7), "hello\x00\x00", time.Time{}, nil},
+		{"mtime", attrTimes, binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 0), uint32(mtime.Unix())), "hello", mtime, nil},
+		{"permissions", attrPermissions, binary.BigEndian.AppendUint32(nil, 0o644), "hello", time.Time{}, sftp.ErrSSHFxOpUnsupported},
+	}
+
+	for _, c := range cases {
+		m := newMemFS(map[string]string{"/a": "hello"})
+		handler := &DufsHandler{
+			fs: m,
+		}
+
+		r := sftp.NewRequest("Setstat", "/a")
+		r.Flags = c.flags
+		r.Attrs = c.attrs
+
+		err := handler.Filecmd(r)
+		if !errors.Is(err, c.err) {
+			t.Errorf("Expected %v for %s but got %v", c.err, c.name, err)
+		}
+
+		content, _ := m.content("/a")
+		if content != c.content {
+			t.Errorf("Expected %q for %s but got %q", c.content, c.name, content)
+		}
+		if !m.mtimes["/a"].Equal(c.mtime) {
+			t.Errorf("Expected %s for %s but got %s", c.mtime, c.name, m.mtimes["/a"])
+		}
+	}
+}
+
+// the flags of an SFTP open, as in draft-ietf-secsh-filexfer-02
+const (
+	openWrite  = 0x2
+	openAppend = 0x4
+	openCreate = 0x8
+	openTrunc  = 0x10
+)
+
+type chunk struct {
+	data string
+	off  int64
+}
+
+func TestFilewriteAppend(t *testing.T) {
+	cases := []struct {
+		name    string
+		chunks  []chunk
+		content string // of /a, which is "hello" at first
+	}{
+		{"from 0", []chunk{{" wo", 0}, {"rld", 3}}, "hello world"},
+		{"from 0 out of order", []chunk{{"rld", 3}, {" wo", 0}}, "hello world"},
+		{"from the end", []chunk{{" wo", 5}, {"rld", 8}}, "hello world"},
+		{"from the end out of order", []chunk{{"rld", 8}, {" wo", 5}}, "hello world"},
+	}
+
+	for _, c := range cases {
+		m := newMemFS(map[string]string{"/a": "hello"})
+		handler := &DufsHandler{
+			fs: m,
+		}
+
+		r := sftp.NewRequest("Put", "/a")
+		r.Flags = openWrite | openAppend
+
+		w, err := handler.Filewrite(r)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		for _, chunk := range c.chunks {
+			_, err = w.WriteAt([]byte(chunk.data), chunk.off)
+			if err != nil {
+				t.Errorf("Expected no error for %s but got %v", c.name, err)
+			}
+		}
+
+		err = w.(io.Closer).Close()
+		if err != nil {
+			t.Errorf("Expected no error for %s but got %v", c.name, err)
+		}
+
+		content, _ := m.content("/a")
+		if content != c.content {
+			t.Errorf("Expected %q for %s but got %q", c.content, c.name, content)
+		}
+	}
+}
+
+func TestWriterAt(t *testing.T) {
+	// ten chunks of 1 MiB, so holding all but the first is beyond maxPending
+	big := make([]chunk, 10)
+	bigContent := ""
+	for i := range big {
+		big[i] = chunk{strings.Repeat(string(rune('a'+i)), 1<<20), int64(i) << 20}
+		bigContent += big[i].data
+	}
+
+	cases := []struct {
+		name    string
+		chunks  []chunk
+		content string // of /a, which does not exist at first, nor at the end if empty
+		err     bool
+	}{
+		{"in order", []chunk{{"abc", 0}, {"def", 3}, {"ghi", 6}}, "abcdefghi", false},
+		{"shuffled", []chunk{{"ghi", 6}, {"abc", 0}, {"jkl", 9}, {"def", 3}}, "abcdefghijkl", false},
+		{"gap at close", []chunk{{"abc", 0}, {"ghi", 6}}, "", true},
+		{"over maxPending", append(big[1:], big[0]), bigContent, false},
+	}
+
+	for _, c := range cases {
+		m := newMemFS(nil)
+		handler := &DufsHandler{
+			fs: m,
+		}
+
+		r := sftp.NewRequest("Put", "/a")
+		r.Flags = openWrite | openCreate | openTrunc
+
+		w, err := handler.Filewrite(r)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		for _, chunk := range c.chunks {
+			_, err = w.WriteAt([]byte(chunk.data), chunk.off)
+			if err != nil {
+				t.Errorf("Expected no error for %s but got %v", c.name, err)
+			}
+		}
+
+		err = w.(io.Closer).Close()
+		if (err != nil) != c.err {
+			t.Errorf("Expected an error for %s to be %t but got %v", c.name, c.err, err)
+		}
+
+		content, ok := m.content("/a")
+		if c.content == "" && ok {
+			t.Errorf("Expected no file for %s but got %d bytes", c.name, len(content))
+		} else if c.content != "" && content != c.content {
+			t.Errorf("Expected %d bytes for %s but got %d", len(c.content), c.name, len(content))
+		}
+	}
+}
+
+func TestFileread(t *testing.T) {
+	m := newMemFS(map[string]string{"/a": "hello"})
+	handler := &DufsHandler{
+		fs: m,
+	}
+
+	reader, err := handler.Fileread(sftp.NewRequest("Get", "/a"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	p := make([]byte, 3)
+	n, _ := reader.ReadAt(p, 2)
+	if string(p[:n]) != "llo" {
+		t.Errorf("Expected %q but got %q", "llo", p[:n])
+	}
+	_ = reader.(io.Closer).Close()
+
+	_, err = handler.Fileread(sftp.NewRequest("Get", "/"))
+	if !errors.Is(err, os.ErrInvalid) {
+		t.Errorf("Expected %v for a directory but got %v", os.ErrInvalid, err)
+	}
+}
+
+func TestFilecmd(t *testing.T) {
+	cases := []struct {
+		method string
+		target string
+		err    error
+		exists []string
+		gone   []string
+	}{
+		{"Rename", "/b", nil, []string{"/b"}, []string{"/a"}},
+		{"PosixRename", "/b", nil, []string{"/b"}, []string{"/a"}},
+		{"Remove", "", nil, nil, []string{"/a"}},
+		{"Mkdir", "", nil, []string{"/a"}, nil},
+		{"Symlink", "/b", sftp.ErrSSHFxOpUnsupported, []string{"/a"}, []string{"/b"}},
+	}
+
+	for _, c := range cases {
+		m := newMemFS(map[string]string{"/a": "hello"})
+		handler := &DufsHandler{
+			fs: m,
+		}
+
+		r := sftp.NewRequest(c.method, "/a")
+		r.Target = c.target
+
+		err := handler.Filecmd(r)
+		if !errors.Is(err, c.err) {
+			t.Errorf("Expected %v for %s but got %v", c.err, c.method, err)
+		}
+
+		for _, name := range c.exists {
+			if _, err := m.Stat(name); err != nil {
+				t.Errorf("Expected %s after %s but got %v", name, c.method, err)
+			}
+		}
+		for _, name := range c.gone {
+			if _, err := m.Stat(name); err == nil {
+				t.Errorf("Expected no %s after %s", name, c.method)
+			}
+		}
+	}
+}
+
+func TestFilelist(t *testing.T) {
+	m := newMemFS(map[string]string{"/a": "hello", "/b": "", "/dir/c": ""})
+	handler := &DufsHandler{
+		fs: m,
+	}
+
+	cases := []struct {
+		method string
+		path   string
+		names  []string
+		sizes  []int64
+	}{
+		{"List", "/", []string{"a", "b"}, []int64{5, 0}},
+		{"Stat", "/a", []string{"a"}, []int64{5}},
+		{"Stat", "/", []string{"/"}, []int64{0}},
+	}
+
+	for _, c := range cases {
+		lister, err := handler.Filelist(sftp.NewRequest(c.method, c.path))
+		if err != nil {
+			t.Errorf("Expected no error for %s %s but got %v", c.method, c.path, err)
+			continue
+		}
+
+		fileInfos := make([]os.FileInfo, 8)
+		n, _ := lister.ListAt(fileInfos, 0)
+
+		var names []string
+		var sizes []int64
+		for _, fileInfo := range fileInfos[:n] {
+			names = append(names, fileInfo.Name())
+			sizes = append(sizes, fileInfo.Size())
+		}
+		if strings.Join(names, ",") != strings.Join(c.names, ",") || !slices.Equal(sizes, c.sizes) {
+			t.Errorf("Expected %v of sizes %v for %s %s but got %v of sizes %v", c.names, c.sizes, c.method, c.path, names, sizes)
+		}
+	}
+}
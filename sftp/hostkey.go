@@ -0,0 +1,139 @@
+package sftp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	HostKeyTypeED25519 = "ed25519"
+	HostKeyTypeECDSA   = "ecdsa"
+	HostKeyTypeRSA     = "rsa"
+)
+
+var HostKeyTypes = []string{HostKeyTypeED25519, HostKeyTypeECDSA, HostKeyTypeRSA}
+
+var ErrUnsupportedHostKeyType = errors.New("unsupported host key type")
+
+// HostKeyPath is the OpenSSH style file name of a host key in dir
+func HostKeyPath(dir, keyType string) string {
+	return filepath.Join(dir, fmt.Sprintf("ssh_host_%s_key", keyType))
+}
+
+func GenerateHostKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case HostKeyTypeED25519:
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		return private, err
+	case HostKeyTypeECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case HostKeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedHostKeyType, keyType)
+	}
+}
+
+// WriteHostKey writes the private key to path and the public key to path.pub
+func WriteHostKey(path string, key crypto.Signer) error {
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return err
+	}
+
+	public, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(path, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(public), 0644)
+}
+
+// LoadHostKeys loads the host keys from paths.
+// When no path is given, one key of each type is loaded from stateDir, and generated there on first start.
+func LoadHostKeys(paths string, stateDir string) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		signer, err := loadHostKey(path)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+
+	if len(signers) > 0 {
+		return signers, nil
+	}
+
+	for _, keyType := range HostKeyTypes {
+		path := HostKeyPath(stateDir, keyType)
+
+		signer, err := loadHostKey(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			l.Info("Generating host key", "type", keyType, "path", path)
+
+			key, err := GenerateHostKey(keyType)
+			if err != nil {
+				return nil, err
+			}
+
+			err = WriteHostKey(path, key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to write host key: %w", err)
+			}
+
+			signer, err = ssh.NewSignerFromSigner(key)
+			if err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, err
+		}
+
+		signers = append(signers, signer)
+	}
+
+	return signers, nil
+}
+
+func loadHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse host key %s: %w", path, err)
+	}
+
+	return signer, nil
+}
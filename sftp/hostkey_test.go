@@ -0,0 +1,46 @@
+package sftp
+
+import (
+	"golang.org/x/crypto/ssh"
+	"testing"
+)
+
+func TestLoadHostKeys(t *testing.T) {
+	stateDir := t.TempDir()
+
+	generated, err := LoadHostKeys("", stateDir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(generated) != len(HostKeyTypes) {
+		t.Fatalf("Expected %d host keys but got %d", len(HostKeyTypes), len(generated))
+	}
+
+	loaded, err := LoadHostKeys("", stateDir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for i := range generated {
+		expected := ssh.FingerprintSHA256(generated[i].PublicKey())
+		actual := ssh.FingerprintSHA256(loaded[i].PublicKey())
+		if expected != actual {
+			t.Errorf("Expected fingerprint %s but got %s", expected, actual)
+		}
+	}
+
+	explicit, err := LoadHostKeys(" "+HostKeyPath(stateDir, HostKeyTypeED25519)+", ", t.TempDir())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(explicit) != 1 || explicit[0].PublicKey().Type() != ssh.KeyAlgoED25519 {
+		t.Errorf("Expected the configured ed25519 host key only")
+	}
+
+	_, err = LoadHostKeys(HostKeyPath(t.TempDir(), HostKeyTypeRSA), stateDir)
+	if err == nil {
+		t.Errorf("Expected error but got nil")
+	}
+}
@@ -3,155 +3,240 @@ package sftp
 // https://pkg.go.dev/golang.org/x/crypto/ssh#example-NewServerConn
 
 import (
-	_ "embed"
+	"context"
+	"errors"
 	"fmt"
+	"github.com/allape/dufs-broker/audit"
+	"github.com/allape/dufs-broker/auth"
+	"github.com/allape/dufs-broker/env"
 	"github.com/allape/dufs-broker/ipnet"
-	"github.com/allape/gogger"
-	"github.com/allape/gohtvfs"
+	"github.com/allape/dufs-broker/logging"
+	"github.com/allape/dufs-broker/metrics"
+	"github.com/allape/dufs-broker/session"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"io"
 	"net"
-	"net/url"
 )
 
-var (
-	//go:embed id_rsa
-	HostKey []byte
-)
+var l = logging.New("sftp")
 
-// ssh-keygen -t rsa -f id_rsa
+type Server struct {
+	authenticator  auth.Authenticator
+	builder        *session.Builder
+	authorizedKeys *AuthorizedKeys
+	hostKeys       []ssh.Signer
+	registry       *session.Registry
+}
 
-var l = gogger.New("sftp")
+func Start(addr string, authenticator auth.Authenticator, builder *session.Builder) (*Server, error) {
+	server := &Server{
+		authenticator: authenticator,
+		builder:       builder,
+		registry:      session.NewRegistry("sftp", env.MaxConnections),
+	}
 
-func Start(addr string, u *url.URL, dufs *gohtvfs.DufsVFS) error {
-	config := &ssh.ServerConfig{
-		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			if c.User() == u.User.Username() {
-				if password, ok := u.User.Password(); ok && string(pass) == password {
-					return nil, nil
-				}
-			}
-			return nil, fmt.Errorf("password rejected for %q", c.User())
-		},
+	metrics.Sessions.Func(func() float64 {
+		return float64(server.registry.Connections())
+	}, "sftp")
+
+	if env.SFTPAuthorizedKeys != "" {
+		keys, err := NewAuthorizedKeys(env.SFTPAuthorizedKeys)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load authorized keys: %w", err)
+		}
+		server.authorizedKeys = keys
 	}
 
-	private, err := ssh.ParsePrivateKey(HostKey)
+	hostKeys, err := LoadHostKeys(env.SFTPHostKeys, env.StateDir)
 	if err != nil {
-		return fmt.Errorf("failed to parse private key: %w", err)
+		return nil, fmt.Errorf("failed to load host keys: %w", err)
 	}
 
-	config.AddHostKey(private)
+	for _, hostKey := range hostKeys {
+		l.Info("Host key", "type", hostKey.PublicKey().Type(), "fingerprint", ssh.FingerprintSHA256(hostKey.PublicKey()))
+	}
+	server.hostKeys = hostKeys
 
 	addrs, err := ipnet.DescriptAddress(addr)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for _, addr := range addrs {
-		go start(addr, config, dufs)
+		l.Info("Starting SFTP server", "addr", addr)
+
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			_ = server.Shutdown(context.Background())
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+
+		go server.serveListener(server.registry.Listener(listener))
 	}
 
-	return nil
+	return server, nil
 }
 
-func start(addr string, config *ssh.ServerConfig, dufs *gohtvfs.DufsVFS) {
-	l.Info().Println("Starting SFTP server on", addr)
+// Shutdown stops accepting clients, waits for transfers until ctx is done, then disconnects every client
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.registry.Shutdown(ctx)
+}
 
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		l.Error().Fatalf("Failed to listen on %s: %v", addr, err)
+// serverConfig creates the config for one connection, users who pass authentication are put into users by name
+func (s *Server) serverConfig(users map[string]*auth.User) *ssh.ServerConfig {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			user, err := s.authenticator.Authenticate(c.User(), string(pass))
+			if err != nil {
+				return nil, fmt.Errorf("password rejected for %q: %w", c.User(), err)
+			}
+			users[c.User()] = user
+			return nil, nil
+		},
+	}
+
+	if s.authorizedKeys != nil {
+		config.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if username, ok := s.authorizedKeys.Lookup(key); ok && username == c.User() {
+				user, err := s.authenticator.Lookup(username)
+				if err == nil {
+					users[c.User()] = user
+					return &ssh.Permissions{
+						Extensions: map[string]string{
+							"pubkey-fp": ssh.FingerprintSHA256(key),
+						},
+					}, nil
+				}
+			}
+			return nil, fmt.Errorf("public key rejected for %q", c.User())
+		}
 	}
-	defer func() {
-		_ = listener.Close()
-	}()
 
+	for _, hostKey := range s.hostKeys {
+		config.AddHostKey(hostKey)
+	}
+
+	return config
+}
+
+func (s *Server) serveListener(listener net.Listener) {
 	for {
 		nConn, err := listener.Accept()
-		if err != nil {
-			l.Error().Println("Failed to accept incoming connection:", err)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			l.Error("Failed to accept incoming connection", "error", err)
 			continue
 		}
 
-		go serve(nConn, config)
+		go s.serve(nConn)
 	}
 }
 
-func serve(nConn net.Conn, config *ssh.ServerConfig) {
-	_, chans, reqs, err := ssh.NewServerConn(nConn, config)
+func (s *Server) serve(nConn net.Conn) {
+	users := map[string]*auth.User{}
+
+	logger := l
+	live := s.registry.Session(nConn, nil)
+	if live != nil {
+		logger = live.Logger(l)
+	}
+
+	// the user name the client tried last, for the audit log
+	attempted := ""
+	config := s.serverConfig(users)
+	config.AuthLogCallback = func(c ssh.ConnMetadata, method string, err error) {
+		attempted = c.User()
+		// every rejected key or password counts, "none" is how clients ask for the methods offered
+		if err != nil && method != "none" {
+			metrics.AuthAttempts.Inc("sftp", "failure")
+		}
+	}
+
+	conn, chans, reqs, err := ssh.NewServerConn(nConn, config)
 	if err != nil {
-		l.Error().Println("Failed to handshake:", err)
+		var authErr *ssh.ServerAuthError
+		if errors.As(err, &authErr) {
+			audit.LoginFailed("sftp", attempted, nConn.RemoteAddr(), err)
+		}
+		logger.Error("Failed to handshake", "error", err)
 		return
 	}
+	metrics.AuthAttempts.Inc("sftp", "success")
+	defer func() {
+		_ = conn.Close()
+	}()
 
-	l.Debug().Println("Handshake successful")
+	user := users[conn.User()]
+
+	if live != nil {
+		live.Login(user.Name)
+		logger = live.Logger(l)
+	}
+
+	fs, err := s.builder.FS(user, live)
+	if err != nil {
+		logger.Error("Failed to create session filesystem", "error", err)
+		return
+	}
+	fs = metrics.Count(fs, "sftp", user.Name)
+	fs = audit.Wrap(fs, "sftp", user.Name, user.Home, audit.IP(nConn.RemoteAddr()))
+
+	if live != nil {
+		fs = live.Track(fs)
+	} else {
+		fs = s.registry.Track(fs)
+	}
+
+	logger.Info("Logged in")
 
 	go ssh.DiscardRequests(reqs)
 
 	for c := range chans {
-		l.Debug().Println("Incoming channel: %s", c.ChannelType())
-
 		if c.ChannelType() != "session" {
 			_ = c.Reject(ssh.UnknownChannelType, "unknown channel type")
-			l.Debug().Println("Unknown channel type: %s", c.ChannelType())
+			logger.Debug("Rejected channel", "type", c.ChannelType())
 			continue
 		}
 
 		channel, requests, err := c.Accept()
 		if err != nil {
-			l.Error().Println("could not accept channel.", err)
+			logger.Error("Failed to accept channel", "error", err)
 			break
 		}
 
-		l.Debug().Println("Channel accepted")
+		logger.Debug("Channel accepted", "type", c.ChannelType())
 
 		go func(in <-chan *ssh.Request) {
 			for req := range in {
-				l.Debug().Println("Request: %v", req.Type)
 				ok := false
+				subsystem := ""
 				switch req.Type {
 				case "subsystem":
-					l.Debug().Println("Subsystem: %s", req.Payload[4:])
-					if string(req.Payload[4:]) == "sftp" {
-						ok = true
+					if len(req.Payload) > 4 {
+						subsystem = string(req.Payload[4:])
 					}
+					ok = subsystem == "sftp"
 				}
-				l.Debug().Println(" - accepted: %v\n", ok)
+				logger.Debug("Channel request", "type", req.Type, "subsystem", subsystem, "accepted", ok)
 				_ = req.Reply(ok, nil)
 			}
 		}(requests)
 
-		serverOptions := []sftp.ServerOption{
-			sftp.WithDebug(l.Debug().Writer()),
-		}
-
-		//if readOnly {
-		//	serverOptions = append(serverOptions, sftp.ReadOnly())
-		//	l.Debug().Println("Read-only server")
-		//} else {
-		//	l.Debug().Println("Read write server")
-		//}
-
-		server, err := sftp.NewServer(
-			channel,
-			serverOptions...,
-		)
-		if err != nil {
-			l.Error().Println("Failed to create server:", err)
-			break
-		}
+		server := sftp.NewRequestServer(channel, NewDufsHandlers(fs))
 		if err := server.Serve(); err != nil {
 			if err != io.EOF {
-				l.Error().Println("sftp server completed with error:", err)
+				logger.Error("SFTP server completed with error", "error", err)
 				break
 			}
 		}
 
 		err = server.Close()
 		if err != nil {
-			l.Error().Println("Failed to close server:", err)
+			logger.Error("Failed to close server", "error", err)
 		}
 
-		l.Debug().Println("sftp client exited session.")
+		logger.Debug("Client exited session")
 	}
 }
@@ -0,0 +1,354 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/allape/dufs-broker/logging"
+	"github.com/allape/gohtvfs"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var l = logging.New("upstream")
+
+var ErrOffline = errors.New("dufs server is offline")
+
+// Pool sends the requests for a dufs server to one of its replicas which is online.
+// Replicas are dufs servers sharing the same files, requests keep the credentials of the first one, the primary.
+// Reads are spread over the replicas online and retried on the next one if a replica is down,
+// writes go to the first replica online, and to the next one only if the connection failed,
+// or to the primary only if writes are pinned.
+type Pool struct {
+	transport http.RoundTripper
+	replicas  []*replica
+	pinWrites bool
+	next      atomic.Uint32
+
+	locker  sync.Mutex
+	changed chan struct{} // closed when a replica goes online or offline
+}
+
+type replica struct {
+	url     *url.URL
+	online  atomic.Bool
+	latency atomic.Int64 // of the last health check
+	checked atomic.Int64 // unix nano of the last health check
+}
+
+// ReplicaStatus is what the last health check of a replica found
+type ReplicaStatus struct {
+	URL     string        `json:"url"` // without password
+	Online  bool          `json:"online"`
+	Latency time.Duration `json:"latency"` // nanoseconds in JSON
+	Checked time.Time     `json:"checked"` // zero if never checked
+}
+
+func NewPool(urls []string, transport http.RoundTripper, pinWrites bool) (*Pool, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("no dufs server")
+	}
+
+	p := &Pool{
+		transport: transport,
+		pinWrites: pinWrites,
+		changed:   make(chan struct{}),
+	}
+
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("no host in dufs server URL %q", u.Redacted())
+		}
+		r := &replica{
+			url: u,
+		}
+		r.online.Store(true)
+		p.replicas = append(p.replicas, r)
+	}
+
+	return p, nil
+}
+
+// Primary is the URL requests are addressed to
+func (p *Pool) Primary() *url.URL {
+	u := *p.replicas[0].url
+	return &u
+}
+
+// Online reports whether any replica is online
+func (p *Pool) Online() bool {
+	for _, r := range p.replicas {
+		if r.online.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+// Wait returns once a replica is online, or ErrOffline when ctx is done before that
+func (p *Pool) Wait(ctx context.Context) error {
+	for {
+		p.locker.Lock()
+		changed := p.changed
+		p.locker.Unlock()
+
+		if p.Online() {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", ErrOffline, ctx.Err())
+		}
+	}
+}
+
+// Status of every replica, the primary first
+func (p *Pool) Status() []ReplicaStatus {
+	statuses := make([]ReplicaStatus, len(p.replicas))
+	for i, r := range p.replicas {
+		statuses[i] = ReplicaStatus{
+			URL:     r.url.Redacted(),
+			Online:  r.online.Load(),
+			Latency: time.Duration(r.latency.Load()),
+		}
+		if checked := r.checked.Load(); checked > 0 {
+			statuses[i].Checked = time.Unix(0, checked)
+		}
+	}
+	return statuses
+}
+
+// Check sends a HEAD request to every replica, any response but 5xx means it is online
+func (p *Pool) Check(ctx context.Context) error {
+	var errs []error
+	for _, r := range p.replicas {
+		err := p.check(ctx, r)
+		p.mark(r, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.url.Redacted(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *Pool) check(ctx context.Context, r *replica) error {
+	u := *r.url
+	u.User = nil
+
+	ctx, cancel := context.WithTimeout(ctx, gohtvfs.DefaultOnlineTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, healthCheck{}, true), http.MethodHead, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	defer func() {
+		r.latency.Store(int64(time.Since(start)))
+		r.checked.Store(time.Now().UnixNano())
+	}()
+
+	resp, err := p.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	l.Debug("Dufs replica answered", "url", r.url.Redacted(), "status", resp.Status, "latency", time.Since(start))
+
+	if unavailable(resp.StatusCode) {
+		return errors.New(resp.Status)
+	}
+
+	return nil
+}
+
+// Run checks the replicas every interval until ctx is done
+func (p *Pool) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		_ = p.Check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// mark records the state of r, and logs when it changes
+func (p *Pool) mark(r *replica, err error) {
+	online := err == nil
+	if r.online.Swap(online) == online {
+		return
+	}
+
+	p.locker.Lock()
+	close(p.changed)
+	p.changed = make(chan struct{})
+	p.locker.Unlock()
+
+	if online {
+		l.Info("Dufs server is back online", "url", r.url.Redacted())
+	} else {
+		l.Warn("Dufs server is offline", "url", r.url.Redacted(), "error", err)
+	}
+}
+
+// candidates are the replicas to try in order, those offline are the last resort
+func (p *Pool) candidates(read bool) []*replica {
+	if len(p.replicas) == 1 {
+		return p.replicas
+	}
+
+	if !read && p.pinWrites {
+		return p.replicas[:1]
+	}
+
+	start := 0
+	if read {
+		start = int(p.next.Add(1)) % len(p.replicas)
+	}
+
+	online := make([]*replica, 0, len(p.replicas))
+	var offline []*replica
+	for i := range p.replicas {
+		r := p.replicas[(start+i)%len(p.replicas)]
+		if r.online.Load() {
+			online = append(online, r)
+		} else {
+			offline = append(offline, r)
+		}
+	}
+
+	return append(online, offline...)
+}
+
+// RoundTrip fails with ErrOffline if no replica could be reached
+func (p *Pool) RoundTrip(req *http.Request) (*http.Response, error) {
+	read := idempotent(req.Method)
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	candidates := p.candidates(read)
+
+	var lastErr error
+	for i, r := range candidates {
+		last := i == len(candidates)-1
+
+		outgoing, err := p.rewrite(req, r, i > 0)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := p.transport.RoundTrip(outgoing)
+		if err == nil && (!read || !unavailable(resp.StatusCode)) {
+			p.mark(r, nil)
+			return resp, nil
+		}
+
+		if err != nil {
+			if req.Context().Err() != nil {
+				return nil, err
+			}
+			p.mark(r, err)
+			// a write is sent again only if it never reached the replica
+			if !replayable || (!read && !dialFailed(err)) {
+				return nil, p.offline(err)
+			}
+			lastErr = err
+			continue
+		}
+
+		if last || !replayable {
+			return resp, nil
+		}
+		_ = resp.Body.Close()
+		lastErr = errors.New(resp.Status)
+		p.mark(r, lastErr)
+	}
+
+	return nil, p.offline(lastErr)
+}
+
+// offline wraps err with ErrOffline once no replica is left online
+func (p *Pool) offline(err error) error {
+	if p.Online() {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrOffline, err)
+}
+
+// rewrite addresses a copy of req to r instead of the primary, the body is read again for a retry
+func (p *Pool) rewrite(req *http.Request, r *replica, retry bool) (*http.Request, error) {
+	primary := p.replicas[0].url
+	if r.url == primary && !retry {
+		return req, nil
+	}
+
+	outgoing := req.Clone(req.Context())
+	outgoing.Host = ""
+	outgoing.URL = rebase(req.URL, primary, r.url)
+
+	if destination := req.Header.Get("Destination"); destination != "" {
+		if u, err := url.Parse(destination); err == nil && u.Host == primary.Host {
+			outgoing.Header.Set("Destination", rebase(u, primary, r.url).String())
+		}
+	}
+
+	if retry && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		outgoing.Body = body
+	}
+
+	return outgoing, nil
+}
+
+// rebase moves u from the base URL from to the base URL to
+func rebase(u, from, to *url.URL) *url.URL {
+	rebased := *u
+	rebased.Scheme = to.Scheme
+	rebased.Host = to.Host
+	rebased.Path = strings.TrimSuffix(to.Path, "/") + strings.TrimPrefix(u.Path, strings.TrimSuffix(from.Path, "/"))
+	rebased.RawPath = ""
+	if u.RawPath != "" {
+		rebased.RawPath = strings.TrimSuffix(to.EscapedPath(), "/") + strings.TrimPrefix(u.RawPath, strings.TrimSuffix(from.EscapedPath(), "/"))
+	}
+	return &rebased
+}
+
+// idempotent requests only read, they can be sent to any replica and sent again
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		return true
+	}
+	return false
+}
+
+// dialFailed reports whether err happened before anything was sent
+func dialFailed(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// unavailable is a response of a proxy in front of a replica which is down
+func unavailable(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
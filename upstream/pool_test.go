@@ -0,0 +1,128 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	var locker sync.Mutex
+	var hits []string
+	handler := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			locker.Lock()
+			defer locker.Unlock()
+			hits = append(hits, name+" "+r.Method+" "+r.URL.Path+" "+r.Header.Get("Destination"))
+		})
+	}
+
+	primary := httptest.NewServer(handler("primary"))
+	defer primary.Close()
+
+	replica := httptest.NewServer(handler("replica"))
+	defer replica.Close()
+
+	down := httptest.NewServer(handler("down"))
+	down.Close()
+
+	pool, err := NewPool([]string{primary.URL + "/share", down.URL, replica.URL + "/files/"}, http.DefaultTransport, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	client := &http.Client{
+		Transport: pool,
+	}
+
+	send := func(method, path, destination string) {
+		req, err := http.NewRequest(method, primary.URL+"/share"+path, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if destination != "" {
+			req.Header.Set("Destination", primary.URL+"/share"+destination)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		_ = resp.Body.Close()
+	}
+
+	for range 3 {
+		send(http.MethodGet, "/a", "")
+	}
+
+	pool.next.Store(0) // the next read starts from the replica offline
+	send(http.MethodGet, "/b", "")
+	send("MOVE", "/b", "/c")
+
+	if err = pool.Check(context.Background()); err == nil {
+		t.Errorf("Expected an error for the replica offline but got nil")
+	}
+
+	pool.replicas[0].online.Store(false)
+	send("MOVE", "/c", "/d")
+
+	pool.pinWrites = true
+	send(http.MethodDelete, "/d", "")
+
+	expected := []string{
+		"replica GET /files/a ",
+		"replica GET /files/a ",
+		"primary GET /share/a ",
+		"replica GET /files/b ",
+		"primary MOVE /share/b " + primary.URL + "/share/c",
+		"primary HEAD /share ",
+		"replica HEAD /files/ ",
+		"replica MOVE /files/c " + replica.URL + "/files/d",
+		"primary DELETE /share/d ",
+	}
+
+	if len(hits) != len(expected) {
+		t.Fatalf("Expected %q but got %q", expected, hits)
+	}
+	for i := range expected {
+		if hits[i] != expected[i] {
+			t.Errorf("Expected %q but got %q", expected[i], hits[i])
+		}
+	}
+}
+
+func TestPoolWait(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	pool, err := NewPool([]string{server.URL}, http.DefaultTransport, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	pool.replicas[0].online.Store(false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err = pool.Wait(ctx); !errors.Is(err, ErrOffline) {
+		t.Errorf("Expected ErrOffline but got %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = pool.Check(context.Background())
+	}()
+
+	if err = pool.Wait(context.Background()); err != nil {
+		t.Errorf("Expected nil but got %v", err)
+	}
+
+	status := pool.Status()[0]
+	if !status.Online || status.Checked.IsZero() {
+		t.Errorf("Expected an online replica checked but got %+v", status)
+	}
+}
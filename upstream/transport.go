@@ -0,0 +1,77 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"github.com/allape/dufs-broker/metrics"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Transport is shared by every DufsVFS, its TLS config can be replaced while in use
+type Transport struct {
+	transport atomic.Pointer[http.Transport]
+}
+
+func NewTransport(tlsConfig *tls.Config) *Transport {
+	t := &Transport{}
+	t.SetTLSConfig(tlsConfig)
+	return t
+}
+
+// SetTLSConfig applies to new connections, requests in flight finish on the old ones
+func (t *Transport) SetTLSConfig(tlsConfig *tls.Config) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	old := t.transport.Swap(transport)
+	if old != nil {
+		old.CloseIdleConnections()
+	}
+}
+
+// WithSession sets SessionHeader to id on every request sent through transport
+func WithSession(transport http.RoundTripper, id string) http.RoundTripper {
+	return &sessionTransport{
+		transport: transport,
+		id:        id,
+	}
+}
+
+type sessionTransport struct {
+	transport http.RoundTripper
+	id        string
+}
+
+func (s *sessionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if req.Header == nil { // gohtvfs may leave it nil
+		req.Header = http.Header{}
+	}
+	req.Header.Set(SessionHeader, s.id)
+	return s.transport.RoundTrip(req)
+}
+
+// healthCheck marks the context of the requests of health checks, which have their own metrics
+type healthCheck struct{}
+
+// RoundTrip counts every request to dufs but health checks
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Context().Value(healthCheck{}) != nil {
+		return t.transport.Load().RoundTrip(req)
+	}
+
+	start := time.Now()
+
+	resp, err := t.transport.Load().RoundTrip(req)
+
+	metrics.UpstreamDuration.Observe(time.Since(start).Seconds(), req.Method)
+	if err != nil {
+		metrics.UpstreamRequests.Inc(req.Method, "error")
+	} else {
+		metrics.UpstreamRequests.Inc(req.Method, strconv.Itoa(resp.StatusCode))
+	}
+
+	return resp, err
+}
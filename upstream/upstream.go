@@ -0,0 +1,92 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"github.com/allape/dufs-broker/logging"
+	"github.com/allape/gohtvfs"
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+var ErrUnauthorized = errors.New("unauthorized by dufs")
+
+// SessionHeader carries the ID of the session a request is sent for, so the logs of the broker and of dufs can be joined
+const SessionHeader = "X-Dubroker-Session"
+
+var dufsLogger = logging.New("dufs")
+
+// Factory creates DufsVFS instances for the same dufs server, one per set of credentials
+type Factory struct {
+	root      *url.URL
+	transport http.RoundTripper
+}
+
+func NewFactory(root string, transport http.RoundTripper) (*Factory, error) {
+	u, err := url.Parse(root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Factory{
+		root:      u,
+		transport: transport,
+	}, nil
+}
+
+// Root is the dufs server URL, including the credentials in it if any
+func (f *Factory) Root() *url.URL {
+	u := *f.root
+	return &u
+}
+
+// New creates a DufsVFS that authenticates with user, or with the credentials in the root URL when user is nil
+func (f *Factory) New(user *url.Userinfo) (*gohtvfs.DufsVFS, error) {
+	u := f.Root()
+	if user != nil {
+		u.User = user
+	}
+
+	dufs, err := gohtvfs.NewDufsVFS(u.String())
+	if err != nil {
+		return nil, err
+	}
+	dufs.HttpClient.Transport = f.transport
+	dufs.SetLogger(slog.NewLogLogger(dufsLogger.Handler(), slog.LevelDebug))
+
+	return dufs, nil
+}
+
+// Verify asks dufs whether it accepts user, with a HEAD request to the root
+func (f *Factory) Verify(user *url.Userinfo) error {
+	u := f.Root()
+	u.User = user
+
+	req, err := http.NewRequest(http.MethodHead, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{
+		Transport: f.transport,
+		Timeout:   gohtvfs.DefaultOnlineTimeout,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return ErrUnauthorized
+	case resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices:
+		return fmt.Errorf("unexpected response from dufs: %s", resp.Status)
+	}
+
+	return nil
+}
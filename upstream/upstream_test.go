@@ -0,0 +1,39 @@
+package upstream
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		switch {
+		case !ok || username != "alice":
+			w.WriteHeader(http.StatusUnauthorized)
+		case password != "alice":
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	factory, err := NewFactory(server.URL, http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err = factory.Verify(url.UserPassword("alice", "alice")); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if err = factory.Verify(url.UserPassword("alice", "bob")); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected ErrUnauthorized but got %v", err)
+	}
+
+	if err = factory.Verify(nil); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected ErrUnauthorized but got %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+func printVersion(_ []string) error {
+	fmt.Println("dufs-broker", version)
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return nil
+	}
+
+	fmt.Println("go:", info.GoVersion)
+
+	settings := map[string]string{}
+	for _, setting := range info.Settings {
+		settings[setting.Key] = setting.Value
+	}
+
+	if revision := settings["vcs.revision"]; revision != "" {
+		if settings["vcs.modified"] == "true" {
+			revision += " (modified)"
+		}
+		fmt.Println("commit:", revision)
+	}
+
+	if built := settings["vcs.time"]; built != "" {
+		fmt.Println("commit time:", built)
+	}
+
+	return nil
+}
@@ -0,0 +1,189 @@
+package vfs
+
+import (
+	"fmt"
+	"github.com/allape/dufs-broker/acl"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	ErrCrossedBoundary = fmt.Errorf("path escapes the root directory: %w", fs.ErrPermission)
+	ErrInvalidPath     = fmt.Errorf("invalid path: %w", fs.ErrPermission)
+)
+
+// JailPath resolves name inside root.
+// Absolute names start from root, and names that climb above root with ".." are rejected,
+// so are names with backslashes, NUL or encoded slashes, which may be decoded into separators later on.
+func JailPath(root, name string) (string, error) {
+	lower := strings.ToLower(name)
+	if strings.ContainsAny(name, "\\\x00") || strings.Contains(lower, "%2f") || strings.Contains(lower, "%5c") {
+		return "", &fs.PathError{
+			Op:   "jail",
+			Path: name,
+			Err:  ErrInvalidPath,
+		}
+	}
+
+	depth := 0
+	for _, segment := range strings.Split(name, "/") {
+		switch segment {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return "", &fs.PathError{
+					Op:   "jail",
+					Path: name,
+					Err:  ErrCrossedBoundary,
+				}
+			}
+		default:
+			depth++
+		}
+	}
+
+	return path.Join(acl.Clean(root), acl.Clean(name)), nil
+}
+
+// Chroot jails fsys into root
+func Chroot(fsys FS, root string) FS {
+	return &Chrooted{
+		fs:   fsys,
+		root: acl.Clean(root),
+	}
+}
+
+type Chrooted struct {
+	fs   FS
+	root string
+}
+
+func (c *Chrooted) path(name string) (string, error) {
+	return JailPath(c.root, name)
+}
+
+// rename hides the real path of the root from the name of fileInfo
+func (c *Chrooted) rename(fileInfo fs.FileInfo) fs.FileInfo {
+	name := fileInfo.Name()
+	if c.root == "/" || !strings.HasPrefix(name, "/") {
+		return fileInfo
+	}
+	return &renamedFileInfo{
+		FileInfo: fileInfo,
+		name:     acl.Clean(strings.TrimPrefix(acl.Clean(name), c.root)),
+	}
+}
+
+func (c *Chrooted) Open(name string) (File, error) {
+	p, err := c.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := c.fs.Open(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ChrootedFile{
+		File:     file,
+		chrooted: c,
+		name:     acl.Clean(name),
+	}, nil
+}
+
+func (c *Chrooted) Stat(name string) (fs.FileInfo, error) {
+	p, err := c.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := c.fs.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.rename(fileInfo), nil
+}
+
+func (c *Chrooted) ReadDir(name string) ([]fs.FileInfo, error) {
+	p, err := c.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.fs.ReadDir(p)
+}
+
+func (c *Chrooted) Mkdir(name string, perm fs.FileMode) error {
+	p, err := c.path(name)
+	if err != nil {
+		return err
+	}
+	return c.fs.Mkdir(p, perm)
+}
+
+func (c *Chrooted) Remove(name string) error {
+	p, err := c.path(name)
+	if err != nil {
+		return err
+	}
+	return c.fs.Remove(p)
+}
+
+func (c *Chrooted) Rename(oldname, newname string) error {
+	oldpath, err := c.path(oldname)
+	if err != nil {
+		return err
+	}
+	newpath, err := c.path(newname)
+	if err != nil {
+		return err
+	}
+	return c.fs.Rename(oldpath, newpath)
+}
+
+func (c *Chrooted) Chtimes(name string, mtime time.Time) error {
+	p, err := c.path(name)
+	if err != nil {
+		return err
+	}
+	return c.fs.Chtimes(p, mtime)
+}
+
+type ChrootedFile struct {
+	File
+	chrooted *Chrooted
+	name     string
+}
+
+func (f *ChrootedFile) Name() string {
+	return f.name
+}
+
+func (f *ChrootedFile) Stat() (fs.FileInfo, error) {
+	fileInfo, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return f.chrooted.rename(fileInfo), nil
+}
+
+func (f *ChrootedFile) CachedStat() (fs.FileInfo, error) {
+	fileInfo, err := f.File.CachedStat()
+	if err != nil {
+		return nil, err
+	}
+	return f.chrooted.rename(fileInfo), nil
+}
+
+type renamedFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (i *renamedFileInfo) Name() string {
+	return i.name
+}
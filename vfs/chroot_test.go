@@ -0,0 +1,52 @@
+package vfs
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+type JailPathTestCase struct {
+	Root     string
+	Name     string
+	Expected string
+	hasError bool
+}
+
+func TestJailPath(t *testing.T) {
+	cases := []JailPathTestCase{
+		{"/home/alice", "/", "/home/alice", false},
+		{"/home/alice", "", "/home/alice", false},
+		{"/home/alice", "docs/a.txt", "/home/alice/docs/a.txt", false},
+		{"/home/alice", "/docs/./a.txt", "/home/alice/docs/a.txt", false},
+		{"/home/alice", "/docs/../a.txt", "/home/alice/a.txt", false},
+		{"home/alice/", "/etc/passwd", "/home/alice/etc/passwd", false},
+		{"/", "/a", "/a", false},
+		{"/home/alice", "..", "", true},
+		{"/home/alice", "/../bob", "", true},
+		{"/home/alice", "docs/../../bob", "", true},
+		{"/home/alice", "..%2fbob", "", true},
+		{"/home/alice", "..%2Fbob", "", true},
+		{"/home/alice", "..%5cbob", "", true},
+		{"/home/alice", "..\\bob", "", true},
+		{"/home/alice", "a\x00b", "", true},
+	}
+
+	for _, c := range cases {
+		jailed, err := JailPath(c.Root, c.Name)
+		if c.hasError {
+			if !errors.Is(err, fs.ErrPermission) {
+				t.Errorf("Expected permission error for %q but got %v", c.Name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		if jailed != c.Expected {
+			t.Errorf("Expected %s but got %s", c.Expected, jailed)
+		}
+	}
+}
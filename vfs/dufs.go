@@ -0,0 +1,282 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"github.com/allape/gohtvfs"
+	"io"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HTTPStatusError is an unexpected status of a response from dufs
+type HTTPStatusError struct {
+	Code   int
+	Status string // the status line, such as 405 Method Not Allowed
+}
+
+func (e *HTTPStatusError) Error() string {
+	return e.Status
+}
+
+func NewDufs(dufs *gohtvfs.DufsVFS) FS {
+	return &Dufs{
+		dufs: dufs,
+	}
+}
+
+type Dufs struct {
+	dufs *gohtvfs.DufsVFS
+}
+
+func (d *Dufs) Open(name string) (File, error) {
+	file, err := d.dufs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &DufsFile{
+		DufsFile: file.(*gohtvfs.DufsFile),
+	}, nil
+}
+
+func (d *Dufs) Stat(name string) (fs.FileInfo, error) {
+	return d.dufs.Stat(name)
+}
+
+func (d *Dufs) ReadDir(name string) ([]fs.FileInfo, error) {
+	entries, err := d.dufs.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return infos(entries)
+}
+
+func (d *Dufs) Mkdir(name string, perm fs.FileMode) error {
+	return d.dufs.Mkdir(name, perm)
+}
+
+func (d *Dufs) Remove(name string) error {
+	return d.dufs.Remove(name)
+}
+
+func (d *Dufs) Rename(oldname, newname string) error {
+	return d.dufs.Rename(oldname, newname)
+}
+
+// Chtimes is not supported, dufs sets the modification time of every upload itself
+func (d *Dufs) Chtimes(name string, _ time.Time) error {
+	return &fs.PathError{
+		Op:   "chtimes",
+		Path: name,
+		Err:  errors.ErrUnsupported,
+	}
+}
+
+type DufsFile struct {
+	*gohtvfs.DufsFile
+
+	locker sync.Mutex
+	offset int64         // of Read
+	body   io.ReadCloser // of the GET Read streams from, if any
+}
+
+func (f *DufsFile) Name() string {
+	return f.DufsFile.Name
+}
+
+// Read streams the file from the offset in a single ranged GET, instead of a GET for every call as gohtvfs does,
+// so a download resumed from an offset is neither started over nor split into small requests
+func (f *DufsFile) Read(p []byte) (int, error) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	if f.body == nil {
+		stat, err := f.CachedStat()
+		if err != nil {
+			return 0, err
+		}
+		if stat.IsDir() {
+			return 0, fs.ErrInvalid
+		}
+		if f.offset >= stat.Size() {
+			return 0, io.EOF
+		}
+
+		f.body, err = f.get(f.offset)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	if err != nil {
+		_ = f.body.Close()
+		f.body = nil
+	}
+	return n, err
+}
+
+// get sends a GET for the file from offset
+func (f *DufsFile) get(offset int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, f.Href.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	resp, err := f.untimedClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	f.FS.GetLogger().Println("Get file", f.DufsFile.Name, "from", offset, "with status code:", resp.StatusCode)
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusOK: // the range is ignored
+		_, err = io.CopyN(io.Discard, resp.Body, offset)
+		if err != nil {
+			_ = resp.Body.Close()
+			return nil, err
+		}
+		return resp.Body, nil
+	case http.StatusNotFound:
+		_ = resp.Body.Close()
+		return nil, fs.ErrNotExist
+	default:
+		_ = resp.Body.Close()
+		return nil, &HTTPStatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+}
+
+// Seek moves the offset of Read, and the one gohtvfs writes at
+func (f *DufsFile) Seek(offset int64, whence int) (int64, error) {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	offset, err := f.DufsFile.Seek(offset, whence)
+	if err != nil {
+		return 0, err
+	}
+
+	if offset != f.offset && f.body != nil {
+		_ = f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+
+	return offset, nil
+}
+
+func (f *DufsFile) Close() error {
+	f.locker.Lock()
+	defer f.locker.Unlock()
+
+	if f.body != nil {
+		_ = f.body.Close()
+		f.body = nil
+	}
+
+	return f.DufsFile.Close()
+}
+
+// ReadFrom replaces the file with r in a PUT.
+// Unlike gohtvfs, the PUT is not cut off by the timeout of the client, as r may be an upload in progress.
+func (f *DufsFile) ReadFrom(r io.Reader) (int64, error) {
+	// only ReadFrom is called, which needs none of the locks NewDufsFile would make
+	upload := &gohtvfs.DufsFile{
+		FS:   &untimedVFS{VFS: f.FS, client: f.untimedClient()},
+		Name: f.DufsFile.Name,
+		Href: f.Href,
+	}
+
+	n, err := upload.ReadFrom(r)
+	if err != nil {
+		return n, err
+	}
+
+	// the stat cached by f is out of date, and only Stat replaces it
+	_, _ = f.DufsFile.Stat()
+
+	return n, nil
+}
+
+// ReadFromAt writes r into the file from off in a PATCH, which is not cut off by the timeout of the client either.
+// off cannot be beyond the end of the file. A dufs server without PATCH answers 405 Method Not Allowed.
+func (f *DufsFile) ReadFromAt(r io.Reader, off int64) (int64, error) {
+	stat, err := f.DufsFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	updateRange := "append"
+	switch {
+	case off > stat.Size():
+		return 0, &fs.PathError{Op: "write", Path: f.DufsFile.Name, Err: fs.ErrInvalid}
+	case off < stat.Size():
+		updateRange = fmt.Sprintf("bytes=%d-", off)
+	}
+
+	n := int64(0)
+	req, err := http.NewRequest(http.MethodPatch, f.Href.String(), gohtvfs.NewSumReader(r, &n))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("X-Update-Range", updateRange)
+
+	resp, err := f.untimedClient().Do(req)
+	if err != nil {
+		return n, err
+	}
+	_ = resp.Body.Close()
+
+	f.FS.GetLogger().Println("Patch file", f.DufsFile.Name, "with status code:", resp.StatusCode, updateRange)
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return n, &HTTPStatusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+
+	_, _ = f.DufsFile.Stat()
+
+	return n, nil
+}
+
+// untimedClient is the client of f without its timeout, for requests which last as long as a transfer
+func (f *DufsFile) untimedClient() *http.Client {
+	client := *f.FS.GetHttpClient()
+	client.Timeout = 0
+	return &client
+}
+
+func (f *DufsFile) ReadDir(n int) ([]fs.FileInfo, error) {
+	entries, err := f.DufsFile.ReadDir(n)
+	if err != nil {
+		return nil, err
+	}
+	return infos(entries)
+}
+
+func infos(entries []fs.DirEntry) ([]fs.FileInfo, error) {
+	fileInfos := make([]fs.FileInfo, len(entries))
+	for i, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		fileInfos[i] = info
+	}
+	return fileInfos, nil
+}
+
+// untimedVFS sends the requests of VFS with client
+type untimedVFS struct {
+	gohtvfs.VFS
+	client *http.Client
+}
+
+func (u *untimedVFS) GetHttpClient() *http.Client {
+	return u.client
+}
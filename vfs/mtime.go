@@ -0,0 +1,316 @@
+package vfs
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mtimeSaveDelay batches the modification times set in a row, such as by rsync, into a single save
+const mtimeSaveDelay = time.Second
+
+// MtimeStore keeps the modification times clients set, which dufs can not store, in a JSON file.
+// A time is only reported as long as dufs reports the same modification time as when it was set,
+// so it is dropped once the file is changed by anyone.
+type MtimeStore struct {
+	file string // empty to keep the times in memory only
+
+	locker  sync.Mutex
+	entries map[string]mtimeEntry // by the URL of the file
+	timer   *time.Timer           // of the pending save, if any
+	err     error                 // of the last save
+}
+
+type mtimeEntry struct {
+	Mtime    time.Time `json:"mtime"`    // set by the client
+	Upstream time.Time `json:"upstream"` // reported by dufs when it was set
+}
+
+// OpenMtimeStore loads the times saved in file if it exists
+func OpenMtimeStore(file string) (*MtimeStore, error) {
+	s := &MtimeStore{
+		file:    file,
+		entries: map[string]mtimeEntry{},
+	}
+
+	if file == "" {
+		return s, nil
+	}
+
+	content, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(content, &s.entries)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Close saves the times set since the last save
+func (s *MtimeStore) Close() error {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+		s.save()
+	}
+
+	return s.err
+}
+
+// get returns the time set for key, unless dufs reports another modification time since
+func (s *MtimeStore) get(key string, upstream time.Time) (time.Time, bool) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	if !sameSecond(entry.Upstream, upstream) {
+		delete(s.entries, key)
+		s.changed()
+		return time.Time{}, false
+	}
+
+	return entry.Mtime, true
+}
+
+func (s *MtimeStore) set(key string, mtime, upstream time.Time) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	s.entries[key] = mtimeEntry{
+		Mtime:    mtime,
+		Upstream: upstream,
+	}
+	s.changed()
+}
+
+// remove drops the times of key and of everything under it
+func (s *MtimeStore) remove(key string) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	for k := range s.entries {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(s.entries, k)
+			s.changed()
+		}
+	}
+}
+
+// rename moves the times of oldkey and of everything under it to newkey
+func (s *MtimeStore) rename(oldkey, newkey string) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	for k := range s.entries {
+		if k == newkey || strings.HasPrefix(k, newkey+"/") {
+			delete(s.entries, k)
+			s.changed()
+		}
+	}
+
+	for k, entry := range s.entries {
+		if k == oldkey || strings.HasPrefix(k, oldkey+"/") {
+			delete(s.entries, k)
+			s.entries[newkey+strings.TrimPrefix(k, oldkey)] = entry
+			s.changed()
+		}
+	}
+}
+
+// changed schedules a save, it is called with the lock held
+func (s *MtimeStore) changed() {
+	if s.file == "" || s.timer != nil {
+		return
+	}
+	s.timer = time.AfterFunc(mtimeSaveDelay, func() {
+		s.locker.Lock()
+		defer s.locker.Unlock()
+
+		if s.timer != nil {
+			s.timer = nil
+			s.save()
+		}
+	})
+}
+
+// save writes the times to a temporary file first, so a crash never leaves a partial one.
+// It is called with the lock held.
+func (s *MtimeStore) save() {
+	content, err := json.Marshal(s.entries)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(s.file), 0700)
+	}
+	if err == nil {
+		err = os.WriteFile(s.file+".tmp", content, 0600)
+	}
+	if err == nil {
+		err = os.Rename(s.file+".tmp", s.file)
+	}
+
+	s.err = err
+	if err != nil {
+		l.Error("Failed to save modification times", "file", s.file, "error", err)
+	}
+}
+
+// sameSecond compares modification times at the precision every dufs response has
+func sameSecond(a, b time.Time) bool {
+	return a.Truncate(time.Second).Equal(b.Truncate(time.Second))
+}
+
+// WithMtimes reports the modification times set on fsys as kept by store.
+// upstream tells the dufs server of fsys apart from the others sharing store, such as its URL.
+func WithMtimes(fsys FS, store *MtimeStore, upstream string) FS {
+	return &Timed{
+		fs:       fsys,
+		store:    store,
+		upstream: strings.TrimSuffix(upstream, "/"),
+	}
+}
+
+type Timed struct {
+	fs       FS
+	store    *MtimeStore
+	upstream string
+}
+
+func (t *Timed) key(name string) string {
+	return t.upstream + path.Clean("/"+name)
+}
+
+// retime replaces the modification time of fileInfo by the one set on name, if any
+func (t *Timed) retime(name string, fileInfo fs.FileInfo) fs.FileInfo {
+	mtime, ok := t.store.get(t.key(name), fileInfo.ModTime())
+	if !ok {
+		return fileInfo
+	}
+	return &retimedFileInfo{
+		FileInfo: fileInfo,
+		modTime:  mtime,
+	}
+}
+
+func (t *Timed) retimeAll(dir string, fileInfos []fs.FileInfo) []fs.FileInfo {
+	for i, fileInfo := range fileInfos {
+		fileInfos[i] = t.retime(path.Join(dir, path.Base(fileInfo.Name())), fileInfo)
+	}
+	return fileInfos
+}
+
+func (t *Timed) Open(name string) (File, error) {
+	file, err := t.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &TimedFile{
+		File:  file,
+		timed: t,
+		name:  name,
+	}, nil
+}
+
+func (t *Timed) Stat(name string) (fs.FileInfo, error) {
+	fileInfo, err := t.fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return t.retime(name, fileInfo), nil
+}
+
+func (t *Timed) ReadDir(name string) ([]fs.FileInfo, error) {
+	fileInfos, err := t.fs.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return t.retimeAll(name, fileInfos), nil
+}
+
+func (t *Timed) Mkdir(name string, perm fs.FileMode) error {
+	return t.fs.Mkdir(name, perm)
+}
+
+func (t *Timed) Remove(name string) error {
+	err := t.fs.Remove(name)
+	if err != nil {
+		return err
+	}
+	t.store.remove(t.key(name))
+	return nil
+}
+
+func (t *Timed) Rename(oldname, newname string) error {
+	err := t.fs.Rename(oldname, newname)
+	if err != nil {
+		return err
+	}
+	t.store.rename(t.key(oldname), t.key(newname))
+	return nil
+}
+
+// Chtimes records mtime against the modification time dufs reports for name now
+func (t *Timed) Chtimes(name string, mtime time.Time) error {
+	fileInfo, err := t.fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	t.store.set(t.key(name), mtime, fileInfo.ModTime())
+	return nil
+}
+
+type TimedFile struct {
+	File
+	timed *Timed
+	name  string
+}
+
+func (f *TimedFile) Stat() (fs.FileInfo, error) {
+	fileInfo, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return f.timed.retime(f.name, fileInfo), nil
+}
+
+func (f *TimedFile) CachedStat() (fs.FileInfo, error) {
+	fileInfo, err := f.File.CachedStat()
+	if err != nil {
+		return nil, err
+	}
+	return f.timed.retime(f.name, fileInfo), nil
+}
+
+func (f *TimedFile) ReadDir(n int) ([]fs.FileInfo, error) {
+	fileInfos, err := f.File.ReadDir(n)
+	if err != nil {
+		return nil, err
+	}
+	return f.timed.retimeAll(f.name, fileInfos), nil
+}
+
+type retimedFileInfo struct {
+	fs.FileInfo
+	modTime time.Time
+}
+
+func (i *retimedFileInfo) ModTime() time.Time {
+	return i.modTime
+}
@@ -0,0 +1,130 @@
+package vfs
+
+import (
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// modFS reports the modification time of every file as dufs would, unaffected by Chtimes
+type modFS struct {
+	FS
+	modTimes map[string]time.Time
+}
+
+func (m *modFS) Stat(name string) (fs.FileInfo, error) {
+	modTime, ok := m.modTimes[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return &modInfo{
+		name:    name,
+		modTime: modTime,
+	}, nil
+}
+
+func (m *modFS) Remove(name string) error {
+	delete(m.modTimes, name)
+	return nil
+}
+
+func (m *modFS) Rename(oldname, newname string) error {
+	m.modTimes[newname] = m.modTimes[oldname]
+	delete(m.modTimes, oldname)
+	return nil
+}
+
+type modInfo struct {
+	fs.FileInfo
+	name    string
+	modTime time.Time
+}
+
+func (i *modInfo) Name() string       { return i.name }
+func (i *modInfo) ModTime() time.Time { return i.modTime }
+
+func TestWithMtimes(t *testing.T) {
+	uploaded := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	set := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	cases := []struct {
+		name   string
+		change func(m *modFS, fsys FS) error
+		path   string
+		want   time.Time
+	}{
+		{
+			name:   "set",
+			change: func(*modFS, FS) error { return nil },
+			path:   "/a",
+			want:   set,
+		},
+		{
+			name: "changed on dufs",
+			change: func(m *modFS, _ FS) error {
+				m.modTimes["/a"] = uploaded.Add(time.Minute)
+				return nil
+			},
+			path: "/a",
+			want: uploaded.Add(time.Minute),
+		},
+		{
+			name: "renamed",
+			change: func(_ *modFS, fsys FS) error {
+				return fsys.Rename("/a", "/b")
+			},
+			path: "/b",
+			want: set,
+		},
+		{
+			name: "removed and uploaded again",
+			change: func(m *modFS, fsys FS) error {
+				err := fsys.Remove("/a")
+				m.modTimes["/a"] = uploaded
+				return err
+			},
+			path: "/a",
+			want: uploaded,
+		},
+	}
+
+	for _, c := range cases {
+		file := filepath.Join(t.TempDir(), "mtimes.json")
+
+		store, err := OpenMtimeStore(file)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		m := &modFS{
+			modTimes: map[string]time.Time{"/a": uploaded},
+		}
+		fsys := WithMtimes(m, store, "http://dufs/")
+
+		err = fsys.Chtimes("/a", set)
+		if err == nil {
+			err = c.change(m, fsys)
+		}
+		if err == nil {
+			err = store.Close()
+		}
+		if err != nil {
+			t.Errorf("Expected no error for %s but got %v", c.name, err)
+			continue
+		}
+
+		// what is reported must survive a restart
+		store, err = OpenMtimeStore(file)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		stat, err := WithMtimes(m, store, "http://dufs").Stat(c.path)
+		if err != nil {
+			t.Errorf("Expected no error for %s but got %v", c.name, err)
+		} else if !stat.ModTime().Equal(c.want) {
+			t.Errorf("Expected %s for %s but got %s", c.want, c.name, stat.ModTime())
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// OpenFile opens name on fsys like os.OpenFile, with the flags dufs can honour.
+// O_CREATE creates the file if it does not exist, and fails with fs.ErrExist if it does together with O_EXCL,
+// O_TRUNC empties it, and O_APPEND sends every write to its end.
+// Writes are uploaded as described by writeFile.
+// A file opened read only is returned as fsys opens it.
+func OpenFile(fsys FS, name string, flag int) (File, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return file, nil
+	}
+
+	return openForWrite(fsys, file, name, flag)
+}
+
+// openForWrite applies flag to file of fsys, which is closed if it fails
+func openForWrite(fsys FS, file File, name string, flag int) (File, error) {
+	fail := func(err error) (File, error) {
+		_ = file.Close()
+		return nil, err
+	}
+
+	exists := true
+	size := int64(0)
+
+	stat, err := file.Stat()
+	switch {
+	case err == nil && stat.IsDir():
+		return fail(&fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid})
+	case err == nil && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return fail(&fs.PathError{Op: "open", Path: name, Err: fs.ErrExist})
+	case err == nil:
+		size = stat.Size()
+	case errors.Is(err, fs.ErrNotExist) && flag&os.O_CREATE != 0:
+		exists = false
+	default:
+		return fail(err)
+	}
+
+	if !exists || (flag&os.O_TRUNC != 0 && size > 0) {
+		// create or empty the file first, so it is there even if nothing is written
+		_, err = file.ReadFrom(bytes.NewReader(nil))
+		if err != nil {
+			return fail(err)
+		}
+		size = 0
+	}
+
+	w := &writeFile{
+		File:   file,
+		append: flag&os.O_APPEND != 0,
+		size:   size,
+	}
+	if !exists {
+		w.remove = func() error {
+			return fsys.Remove(name)
+		}
+	}
+
+	return w, nil
+}
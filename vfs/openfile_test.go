@@ -0,0 +1,194 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// memFS keeps files in memory, and answers like DufsVFS does
+type memFS struct {
+	FS
+	files   map[string][]byte
+	noPatch bool // like a dufs server without PATCH
+	puts    int
+}
+
+func (m *memFS) Open(name string) (File, error) {
+	return &memFile{
+		fs:   m,
+		name: name,
+	}, nil
+}
+
+type memFile struct {
+	File
+	fs     *memFS
+	name   string
+	offset int64
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	content, ok := f.fs.files[f.name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return &memInfo{
+		name: f.name,
+		size: int64(len(content)),
+	}, nil
+}
+
+func (f *memFile) CachedStat() (fs.FileInfo, error) {
+	return f.Stat()
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) Seek(offset int64, _ int) (int64, error) {
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	content := f.fs.files[f.name]
+	if off >= int64(len(content)) {
+		return 0, io.EOF
+	}
+	return copy(p, content[off:]), nil
+}
+
+// ReadFrom replaces the file, like a PUT, which fails if its body is cut off
+func (f *memFile) ReadFrom(r io.Reader) (int64, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(content)), err
+	}
+	f.fs.files[f.name] = content
+	f.fs.puts++
+	return int64(len(content)), nil
+}
+
+// WriteAt patches the file, like a PATCH
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.fs.noPatch {
+		return 0, &HTTPStatusError{Code: http.StatusMethodNotAllowed, Status: "405 Method Not Allowed"}
+	}
+	content := f.fs.files[f.name]
+	f.fs.files[f.name] = append(content[:min(off, int64(len(content)))], p...)
+	return len(p), nil
+}
+
+// ReadFromAt patches the file, like a PATCH
+func (f *memFile) ReadFromAt(r io.Reader, off int64) (int64, error) {
+	if f.fs.noPatch {
+		return 0, &HTTPStatusError{Code: http.StatusMethodNotAllowed, Status: "405 Method Not Allowed"}
+	}
+	p, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	content := f.fs.files[f.name]
+	if off > int64(len(content)) {
+		return 0, fs.ErrInvalid
+	}
+	tail := content[min(off+int64(len(p)), int64(len(content))):]
+	f.fs.files[f.name] = append(append(content[:off:off], p...), tail...)
+	return int64(len(p)), nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	return f.WriteAt(p, int64(len(f.fs.files[f.name])))
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+type memInfo struct {
+	fs.FileInfo
+	name string
+	size int64
+}
+
+func (i *memInfo) Name() string       { return i.name }
+func (i *memInfo) Size() int64        { return i.size }
+func (i *memInfo) IsDir() bool        { return false }
+func (i *memInfo) ModTime() time.Time { return time.Time{} }
+
+func TestOpenFile(t *testing.T) {
+	cases := []struct {
+		name    string
+		flag    int
+		noPatch bool
+		write   string
+		content string // of /a, which is "hello" at first
+		err     error
+	}{
+		{"read", os.O_RDONLY, false, "", "hello", nil},
+		{"missing", os.O_WRONLY, false, "", "hello", fs.ErrNotExist},
+		{"exclusive", os.O_WRONLY | os.O_CREATE | os.O_EXCL, false, "", "hello", fs.ErrExist},
+		{"truncate", os.O_WRONLY | os.O_CREATE | os.O_TRUNC, false, "abc", "abc", nil},
+		{"append", os.O_WRONLY | os.O_APPEND, false, " world", "hello world", nil},
+		{"append without patch", os.O_WRONLY | os.O_CREATE | os.O_APPEND, true, " world", "hello world", nil},
+	}
+
+	for _, c := range cases {
+		m := &memFS{
+			files: map[string][]byte{
+				"/a": []byte("hello"),
+			},
+			noPatch: c.noPatch,
+		}
+
+		name := "/a"
+		if c.err == fs.ErrNotExist {
+			name = "/b"
+		}
+
+		file, err := OpenFile(m, name, c.flag)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: Expected %v but got %v", c.name, c.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if c.write != "" {
+			_, err = file.Write([]byte(c.write))
+			if err != nil {
+				t.Errorf("%s: Unexpected error: %v", c.name, err)
+			}
+		}
+
+		err = file.Close()
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %v", c.name, err)
+		}
+
+		if string(m.files["/a"]) != c.content {
+			t.Errorf("%s: Expected %q but got %q", c.name, c.content, m.files["/a"])
+		}
+	}
+
+	m := &memFS{
+		files: map[string][]byte{},
+	}
+	file, err := OpenFile(m, "/new", os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_ = file.Close()
+	if content, ok := m.files["/new"]; !ok || len(content) != 0 {
+		t.Errorf("Expected /new to be created empty but got %q, %v", content, ok)
+	}
+}
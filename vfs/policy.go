@@ -0,0 +1,215 @@
+package vfs
+
+import (
+	"github.com/allape/dufs-broker/acl"
+	"io"
+	"io/fs"
+	"path"
+	"time"
+)
+
+// WithPolicy checks every operation of user against policy before it reaches fsys
+func WithPolicy(fsys FS, policy acl.Checker, user string) FS {
+	return &Policed{
+		fs:     fsys,
+		policy: policy,
+		user:   user,
+	}
+}
+
+type Policed struct {
+	fs     FS
+	policy acl.Checker
+	user   string
+}
+
+func (p *Policed) check(op, name string, right acl.Right) error {
+	return p.deny(op, name, p.policy.Rights(p.user, name)&right == 0)
+}
+
+// checkTree checks every right on name and on everything under it,
+// since dufs removes and moves directories with their content
+func (p *Policed) checkTree(op, name string, right acl.Right) error {
+	return p.deny(op, name, !p.policy.TreeRights(p.user, name).Has(right))
+}
+
+func (p *Policed) deny(op, name string, denied bool) error {
+	if denied {
+		return &fs.PathError{
+			Op:   op,
+			Path: name,
+			Err:  fs.ErrPermission,
+		}
+	}
+	return nil
+}
+
+func (p *Policed) Open(name string) (File, error) {
+	// the file may be opened to read, to write or to list, each of which is checked on the file
+	err := p.check("open", name, acl.All)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := p.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PolicedFile{
+		File:    file,
+		policed: p,
+		rights:  p.policy.Rights(p.user, name),
+	}, nil
+}
+
+func (p *Policed) Stat(name string) (fs.FileInfo, error) {
+	err := p.check("stat", name, acl.All)
+	if err != nil {
+		return nil, err
+	}
+	return p.fs.Stat(name)
+}
+
+func (p *Policed) ReadDir(name string) ([]fs.FileInfo, error) {
+	err := p.check("readdir", name, acl.List)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfos, err := p.fs.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.visible(name, fileInfos), nil
+}
+
+// visible hides whatever this user can not touch at all
+func (p *Policed) visible(dir string, fileInfos []fs.FileInfo) []fs.FileInfo {
+	visible := fileInfos[:0]
+	for _, fileInfo := range fileInfos {
+		if p.policy.Rights(p.user, path.Join(dir, path.Base(fileInfo.Name()))) != acl.None {
+			visible = append(visible, fileInfo)
+		}
+	}
+	return visible
+}
+
+func (p *Policed) Mkdir(name string, perm fs.FileMode) error {
+	err := p.check("mkdir", name, acl.Write)
+	if err != nil {
+		return err
+	}
+	return p.fs.Mkdir(name, perm)
+}
+
+func (p *Policed) Remove(name string) error {
+	err := p.checkTree("remove", name, acl.Delete)
+	if err != nil {
+		return err
+	}
+	return p.fs.Remove(name)
+}
+
+func (p *Policed) Rename(oldname, newname string) error {
+	// whatever is under oldname must not gain a right it does not have there by being moved
+	rights := p.policy.Rights(p.user, oldname)
+	moved := rights & (acl.Delete | acl.Write)
+	err := p.deny("rename", oldname, !rights.Has(acl.Delete) || !p.policy.TreeRights(p.user, oldname).Has(moved))
+	if err != nil {
+		return err
+	}
+	err = p.checkTree("rename", newname, acl.Write)
+	if err != nil {
+		return err
+	}
+	return p.fs.Rename(oldname, newname)
+}
+
+func (p *Policed) Chtimes(name string, mtime time.Time) error {
+	err := p.check("chtimes", name, acl.Write)
+	if err != nil {
+		return err
+	}
+	return p.fs.Chtimes(name, mtime)
+}
+
+type PolicedFile struct {
+	File
+	policed *Policed
+	rights  acl.Right
+}
+
+func (f *PolicedFile) check(op string, right acl.Right) error {
+	if !f.rights.Has(right) {
+		return &fs.PathError{
+			Op:   op,
+			Path: f.Name(),
+			Err:  fs.ErrPermission,
+		}
+	}
+	return nil
+}
+
+func (f *PolicedFile) Read(p []byte) (int, error) {
+	err := f.check("read", acl.Read)
+	if err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *PolicedFile) ReadAt(p []byte, off int64) (int, error) {
+	err := f.check("read", acl.Read)
+	if err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *PolicedFile) Write(p []byte) (int, error) {
+	err := f.check("write", acl.Write)
+	if err != nil {
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+func (f *PolicedFile) WriteAt(p []byte, off int64) (int, error) {
+	err := f.check("write", acl.Write)
+	if err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func (f *PolicedFile) ReadFrom(r io.Reader) (int64, error) {
+	err := f.check("write", acl.Write)
+	if err != nil {
+		return 0, err
+	}
+	return f.File.ReadFrom(r)
+}
+
+func (f *PolicedFile) ReadFromAt(r io.Reader, off int64) (int64, error) {
+	err := f.check("write", acl.Write)
+	if err != nil {
+		return 0, err
+	}
+	return f.File.ReadFromAt(r, off)
+}
+
+func (f *PolicedFile) ReadDir(n int) ([]fs.FileInfo, error) {
+	err := f.check("readdir", acl.List)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfos, err := f.File.ReadDir(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.policed.visible(f.Name(), fileInfos), nil
+}
@@ -0,0 +1,61 @@
+package vfs
+
+import (
+	"errors"
+	"github.com/allape/dufs-broker/acl"
+	"io/fs"
+	"testing"
+)
+
+// opFS records the operations which reach it
+type opFS struct {
+	FS
+	ops []string
+}
+
+func (o *opFS) Remove(name string) error {
+	o.ops = append(o.ops, "remove "+name)
+	return nil
+}
+
+func (o *opFS) Rename(oldname, newname string) error {
+	o.ops = append(o.ops, "rename "+oldname+" "+newname)
+	return nil
+}
+
+func TestPolicedTree(t *testing.T) {
+	policy, err := acl.NewPolicy([]acl.Rule{
+		{User: acl.Everyone, Path: "/", Rights: []string{"all"}},
+		{User: acl.Everyone, Path: "/a/secret", Rights: []string{"read", "list"}},
+		{User: acl.Everyone, Path: "/inbox", Rights: []string{"read", "delete", "list"}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		op      func(fsys FS) error
+		allowed bool
+	}{
+		{"remove a directory with a read only subtree", func(fsys FS) error { return fsys.Remove("/a") }, false},
+		{"remove the read only subtree", func(fsys FS) error { return fsys.Remove("/a/secret") }, false},
+		{"remove a sibling", func(fsys FS) error { return fsys.Remove("/a/public") }, true},
+		{"rename a directory with a read only subtree", func(fsys FS) error { return fsys.Rename("/a", "/b") }, false},
+		{"rename into the read only subtree", func(fsys FS) error { return fsys.Rename("/c", "/a/secret/c") }, false},
+		{"rename a sibling", func(fsys FS) error { return fsys.Rename("/a/public", "/b") }, true},
+		{"rename out of a directory without write", func(fsys FS) error { return fsys.Rename("/inbox/x", "/b") }, true},
+	}
+
+	for _, c := range cases {
+		inner := &opFS{}
+		err := c.op(WithPolicy(inner, policy, "alice"))
+		if c.allowed && err != nil {
+			t.Errorf("Expected %s to be allowed but got %v", c.name, err)
+		} else if !c.allowed && !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("Expected %s to be denied but got %v", c.name, err)
+		} else if !c.allowed && len(inner.ops) > 0 {
+			t.Errorf("Expected %s not to reach dufs but got %v", c.name, inner.ops)
+		}
+	}
+}
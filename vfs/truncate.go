@@ -0,0 +1,65 @@
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+)
+
+// Truncate changes the size of file, which dufs can only do by rewriting it.
+// Emptying it uploads an empty body, growing it appends zeros with PATCH,
+// and shrinking it, or growing it on a dufs server without PATCH, uploads it again from a ranged read.
+func Truncate(file File, size int64) error {
+	if w, ok := file.(*writeFile); ok {
+		return w.Truncate(size)
+	}
+	return truncate(file, size)
+}
+
+func truncate(file File, size int64) error {
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: file.Name(), Err: fs.ErrInvalid}
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		return &fs.PathError{Op: "truncate", Path: file.Name(), Err: fs.ErrInvalid}
+	}
+
+	switch {
+	case size == stat.Size():
+		return nil
+	case size == 0:
+		_, err = file.ReadFrom(bytes.NewReader(nil))
+		return err
+	case size > stat.Size():
+		_, err = file.ReadFromAt(io.LimitReader(zeros{}, size-stat.Size()), stat.Size())
+		if err == nil || !patchUnsupported(err) {
+			return err
+		}
+	}
+
+	spool, err := download(file, min(size, stat.Size()))
+	if err != nil {
+		return err
+	}
+	defer discard(spool)
+
+	err = spool.Truncate(size)
+	if err != nil {
+		return err
+	}
+
+	return upload(file, spool)
+}
+
+// zeros reads as zeros without end
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,58 @@
+package vfs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestTruncate(t *testing.T) {
+	cases := []struct {
+		name    string
+		size    int64
+		noPatch bool
+		content string // of /a, which is "hello" at first
+	}{
+		{"same", 5, false, "hello"},
+		{"empty", 0, true, ""},
+		{"shrink", 2, true, "he"},
+		{"grow", 7, false, "hello\x00\x00"},
+		{"grow without patch", 7, true, "hello\x00\x00"},
+	}
+
+	for _, c := range cases {
+		m := &memFS{
+			files: map[string][]byte{
+				"/a": []byte("hello"),
+			},
+			noPatch: c.noPatch,
+		}
+		file, _ := m.Open("/a")
+
+		err := Truncate(file, c.size)
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %v", c.name, err)
+		}
+
+		if string(m.files["/a"]) != c.content {
+			t.Errorf("%s: Expected %q but got %q", c.name, c.content, m.files["/a"])
+		}
+	}
+
+	m := &memFS{
+		files: map[string][]byte{},
+	}
+	file, err := OpenFile(m, "/b", os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, _ = file.Write([]byte("abc"))
+	err = Truncate(file, 1)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	_, _ = file.Write([]byte("d"))
+	_ = file.Close()
+	if string(m.files["/b"]) != "a\x00\x00d" {
+		t.Errorf("Expected %q but got %q", "a\x00\x00d", m.files["/b"])
+	}
+}
@@ -0,0 +1,334 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"github.com/allape/dufs-broker/acl"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrCrossMount = fmt.Errorf("can not move across mounts: %w", fs.ErrPermission)
+
+// Mount is a filesystem shown as a top-level directory of a Union
+type Mount struct {
+	Path string // such as /media
+	FS   FS
+}
+
+// Union shows every mount as a directory of its root, the root itself can not be changed
+func Union(mounts []Mount) (FS, error) {
+	u := &Unioned{
+		mounts:  make(map[string]FS, len(mounts)),
+		modTime: time.Now(),
+	}
+
+	for _, mount := range mounts {
+		name := strings.Trim(acl.Clean(mount.Path), "/")
+		if name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("mount path must be a top-level directory: %q", mount.Path)
+		} else if _, ok := u.mounts[name]; ok {
+			return nil, fmt.Errorf("duplicate mount path: %q", mount.Path)
+		}
+		u.mounts[name] = mount.FS
+		u.names = append(u.names, name)
+	}
+
+	sort.Strings(u.names)
+
+	return u, nil
+}
+
+type Unioned struct {
+	mounts  map[string]FS
+	names   []string
+	modTime time.Time
+}
+
+// resolve returns the mount of name and the path inside it, or a nil FS for the root
+func (u *Unioned) resolve(op, name string) (FS, string, string, error) {
+	name = acl.Clean(name)
+	if name == "/" {
+		return nil, "", "/", nil
+	}
+
+	mount, rest, _ := strings.Cut(strings.TrimPrefix(name, "/"), "/")
+
+	fsys, ok := u.mounts[mount]
+	if !ok {
+		return nil, "", "", &fs.PathError{
+			Op:   op,
+			Path: name,
+			Err:  fs.ErrNotExist,
+		}
+	}
+
+	return fsys, "/" + mount, "/" + rest, nil
+}
+
+// rename puts the mount path in front of the real path in the name of fileInfo
+func (u *Unioned) rename(mount string, fileInfo fs.FileInfo) fs.FileInfo {
+	name := fileInfo.Name()
+	if !strings.HasPrefix(name, "/") {
+		return fileInfo
+	}
+	return &renamedFileInfo{
+		FileInfo: fileInfo,
+		name:     path.Join(mount, name),
+	}
+}
+
+func (u *Unioned) readOnly(op, name string) error {
+	return &fs.PathError{
+		Op:   op,
+		Path: name,
+		Err:  fs.ErrPermission,
+	}
+}
+
+func (u *Unioned) Open(name string) (File, error) {
+	fsys, mount, p, err := u.resolve("open", name)
+	if err != nil {
+		return nil, err
+	} else if fsys == nil {
+		return &unionRoot{
+			union: u,
+		}, nil
+	}
+
+	file, err := fsys.Open(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UnionFile{
+		File:  file,
+		union: u,
+		mount: mount,
+	}, nil
+}
+
+func (u *Unioned) Stat(name string) (fs.FileInfo, error) {
+	fsys, mount, p, err := u.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	} else if fsys == nil {
+		return u.dirInfo("/"), nil
+	}
+
+	fileInfo, err := fsys.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return u.rename(mount, fileInfo), nil
+}
+
+func (u *Unioned) ReadDir(name string) ([]fs.FileInfo, error) {
+	fsys, _, p, err := u.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	} else if fsys == nil {
+		return u.list(), nil
+	}
+	return fsys.ReadDir(p)
+}
+
+func (u *Unioned) Mkdir(name string, perm fs.FileMode) error {
+	fsys, _, p, err := u.resolve("mkdir", name)
+	if err != nil {
+		return err
+	} else if fsys == nil || p == "/" {
+		return u.readOnly("mkdir", name)
+	}
+	return fsys.Mkdir(p, perm)
+}
+
+func (u *Unioned) Remove(name string) error {
+	fsys, _, p, err := u.resolve("remove", name)
+	if err != nil {
+		return err
+	} else if fsys == nil || p == "/" {
+		return u.readOnly("remove", name)
+	}
+	return fsys.Remove(p)
+}
+
+func (u *Unioned) Rename(oldname, newname string) error {
+	oldfs, oldmount, oldpath, err := u.resolve("rename", oldname)
+	if err != nil {
+		return err
+	} else if oldfs == nil || oldpath == "/" {
+		return u.readOnly("rename", oldname)
+	}
+
+	newfs, newmount, newpath, err := u.resolve("rename", newname)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && (newfs == nil || newpath == "/")) {
+		return u.readOnly("rename", newname)
+	} else if err != nil {
+		return err
+	}
+
+	if oldmount != newmount {
+		return &os.LinkError{
+			Op:  "rename",
+			Old: oldname,
+			New: newname,
+			Err: ErrCrossMount,
+		}
+	}
+
+	return oldfs.Rename(oldpath, newpath)
+}
+
+// Chtimes of a mount point sets the time of the root of its dufs server, the root of the union has none
+func (u *Unioned) Chtimes(name string, mtime time.Time) error {
+	fsys, _, p, err := u.resolve("chtimes", name)
+	if err != nil {
+		return err
+	} else if fsys == nil {
+		return u.readOnly("chtimes", name)
+	}
+	return fsys.Chtimes(p, mtime)
+}
+
+func (u *Unioned) dirInfo(name string) fs.FileInfo {
+	return &unionDirInfo{
+		name:    name,
+		modTime: u.modTime,
+	}
+}
+
+// list is the mount points, without asking the mounts, so the root is listed even if they are offline
+func (u *Unioned) list() []fs.FileInfo {
+	fileInfos := make([]fs.FileInfo, len(u.names))
+	for i, name := range u.names {
+		fileInfos[i] = u.dirInfo(name)
+	}
+	return fileInfos
+}
+
+type UnionFile struct {
+	File
+	union *Unioned
+	mount string
+}
+
+func (f *UnionFile) Name() string {
+	return path.Join(f.mount, f.File.Name())
+}
+
+func (f *UnionFile) Stat() (fs.FileInfo, error) {
+	fileInfo, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return f.union.rename(f.mount, fileInfo), nil
+}
+
+func (f *UnionFile) CachedStat() (fs.FileInfo, error) {
+	fileInfo, err := f.File.CachedStat()
+	if err != nil {
+		return nil, err
+	}
+	return f.union.rename(f.mount, fileInfo), nil
+}
+
+// unionRoot is the root directory, which only lists the mounts
+type unionRoot struct {
+	union *Unioned
+}
+
+func (r *unionRoot) invalid(op string) error {
+	return &fs.PathError{
+		Op:   op,
+		Path: "/",
+		Err:  fs.ErrInvalid,
+	}
+}
+
+func (r *unionRoot) Read(_ []byte) (int, error) {
+	return 0, r.invalid("read")
+}
+
+func (r *unionRoot) ReadAt(_ []byte, _ int64) (int, error) {
+	return 0, r.invalid("read")
+}
+
+func (r *unionRoot) Write(_ []byte) (int, error) {
+	return 0, r.union.readOnly("write", "/")
+}
+
+func (r *unionRoot) WriteAt(_ []byte, _ int64) (int, error) {
+	return 0, r.union.readOnly("write", "/")
+}
+
+func (r *unionRoot) ReadFrom(_ io.Reader) (int64, error) {
+	return 0, r.union.readOnly("write", "/")
+}
+
+func (r *unionRoot) ReadFromAt(_ io.Reader, _ int64) (int64, error) {
+	return 0, r.union.readOnly("write", "/")
+}
+
+func (r *unionRoot) Seek(_ int64, _ int) (int64, error) {
+	return 0, nil
+}
+
+func (r *unionRoot) Close() error {
+	return nil
+}
+
+func (r *unionRoot) Name() string {
+	return "/"
+}
+
+func (r *unionRoot) Stat() (fs.FileInfo, error) {
+	return r.union.dirInfo("/"), nil
+}
+
+func (r *unionRoot) CachedStat() (fs.FileInfo, error) {
+	return r.Stat()
+}
+
+func (r *unionRoot) ReadDir(n int) ([]fs.FileInfo, error) {
+	fileInfos := r.union.list()
+	if n > 0 && len(fileInfos) > n {
+		fileInfos = fileInfos[:n]
+	}
+	return fileInfos, nil
+}
+
+type unionDirInfo struct {
+	name    string
+	modTime time.Time
+}
+
+func (i *unionDirInfo) Name() string {
+	return i.name
+}
+
+func (i *unionDirInfo) Size() int64 {
+	return 0
+}
+
+func (i *unionDirInfo) Mode() fs.FileMode {
+	return fs.ModeDir | 0555
+}
+
+func (i *unionDirInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+func (i *unionDirInfo) IsDir() bool {
+	return true
+}
+
+func (i *unionDirInfo) Sys() any {
+	return nil
+}
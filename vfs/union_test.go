@@ -0,0 +1,95 @@
+package vfs
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+// statFS answers Stat with the full path as the name, like DufsVFS does
+type statFS struct {
+	FS
+	renamed [][2]string
+}
+
+func (s *statFS) Stat(name string) (fs.FileInfo, error) {
+	return &unionDirInfo{
+		name: name,
+	}, nil
+}
+
+func (s *statFS) Rename(oldname, newname string) error {
+	s.renamed = append(s.renamed, [2]string{oldname, newname})
+	return nil
+}
+
+func TestUnion(t *testing.T) {
+	media := &statFS{}
+	backup := &statFS{}
+
+	union, err := Union([]Mount{
+		{"/media", media},
+		{"backup/", backup},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	fileInfos, err := union.ReadDir("/")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(fileInfos) != 2 || fileInfos[0].Name() != "backup" || fileInfos[1].Name() != "media" {
+		t.Errorf("Expected backup and media but got %v", fileInfos)
+	}
+
+	for name, expected := range map[string]string{
+		"/":            "/",
+		"/media":       "/media",
+		"media/a/b":    "/media/a/b",
+		"/backup/../x": "",
+	} {
+		fileInfo, err := union.Stat(name)
+		if expected == "" {
+			if !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("Expected %v for %s but got %v", fs.ErrNotExist, name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", name, err)
+			continue
+		}
+		if fileInfo.Name() != expected {
+			t.Errorf("Expected %s but got %s", expected, fileInfo.Name())
+		}
+	}
+
+	err = union.Rename("/media/a", "/media/b")
+	if err != nil || len(media.renamed) != 1 || media.renamed[0] != [2]string{"/a", "/b"} {
+		t.Errorf("Expected /a renamed to /b on media but got %v, %v", err, media.renamed)
+	}
+
+	for _, names := range [][2]string{
+		{"/media/a", "/backup/a"},
+		{"/media", "/media2"},
+		{"/media/a", "/"},
+	} {
+		err = union.Rename(names[0], names[1])
+		if !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("Expected %v for %s to %s but got %v", fs.ErrPermission, names[0], names[1], err)
+		}
+	}
+
+	for _, name := range []string{"/", "/media", "/new"} {
+		err = union.Mkdir(name, fs.ModePerm)
+		if !errors.Is(err, fs.ErrPermission) && !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Expected an error for %s but got %v", name, err)
+		}
+	}
+
+	_, err = Union([]Mount{{"/a/b", media}})
+	if err == nil {
+		t.Errorf("Expected error for nested mount but got nil")
+	}
+}
@@ -0,0 +1,318 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// writeFile uploads the writes to a file opened by OpenFile.
+// Writes in order from the start of an empty file are streamed to dufs in a single PUT,
+// and writes in order from anywhere else up to the end of the file in a single PATCH.
+// A write beyond the end of the file, or a write to a dufs server without PATCH, spills the file
+// to a temporary file instead, to which the rest of the writes go, and which is uploaded on Close.
+type writeFile struct {
+	File
+	append bool // every write goes to the end of the file
+
+	locker  sync.Mutex
+	size    int64
+	offset  int64    // where Write writes, moved by Seek
+	patched bool     // dufs is known to support PATCH
+	stream  *stream  // the PUT or PATCH in progress, if any
+	spool   *os.File // nil until the file is spilled
+
+	remove func() error // removes the file if OpenFile created it, nil otherwise
+}
+
+func (w *writeFile) Write(p []byte) (int, error) {
+	w.locker.Lock()
+	defer w.locker.Unlock()
+	if w.append {
+		w.offset = w.size
+	}
+	n, err := w.writeAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+func (w *writeFile) WriteAt(p []byte, off int64) (int, error) {
+	w.locker.Lock()
+	defer w.locker.Unlock()
+	if w.append {
+		off = w.size
+	}
+	return w.writeAt(p, off)
+}
+
+// Seek moves where Write writes, such as to resume an upload, which cannot be beyond the end of the file
+func (w *writeFile) Seek(offset int64, whence int) (int64, error) {
+	w.locker.Lock()
+	defer w.locker.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += w.offset
+	case io.SeekEnd:
+		offset += w.size
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: w.Name(), Err: fs.ErrInvalid}
+	}
+
+	if offset < 0 || offset > w.size {
+		return 0, &fs.PathError{Op: "seek", Path: w.Name(), Err: fs.ErrInvalid}
+	}
+
+	w.offset = offset
+
+	return offset, nil
+}
+
+func (w *writeFile) writeAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if w.spool == nil {
+		if w.stream != nil && off != w.stream.end {
+			err := w.stream.Close()
+			w.stream = nil
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		if w.stream == nil && off <= w.size {
+			switch {
+			case off == 0 && w.size == 0:
+				w.stream = newStream(off, w.File.ReadFrom)
+			case w.patched:
+				w.stream = newStream(off, func(r io.Reader) (int64, error) {
+					return w.File.ReadFromAt(r, off)
+				})
+			default:
+				// the first PATCH is sent on its own, so it can be spilled if dufs does not support PATCH
+				n, err := w.File.ReadFromAt(bytes.NewReader(p), off)
+				if err == nil || !patchUnsupported(err) {
+					w.patched = err == nil
+					w.size = max(w.size, off+n)
+					return int(n), err
+				}
+			}
+		}
+
+		if w.stream != nil {
+			n, err := w.stream.Write(p)
+			w.size = max(w.size, w.stream.end)
+			return n, err
+		}
+
+		err := w.spill()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.spool.WriteAt(p, off)
+	w.size = max(w.size, off+int64(n))
+	return n, err
+}
+
+// ReadFrom writes r from the end of the file, instead of replacing the file with it
+func (w *writeFile) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{w}, r)
+}
+
+// spill downloads the file so far to a temporary file
+func (w *writeFile) spill() error {
+	spool, err := download(w.File, w.size)
+	if err != nil {
+		return err
+	}
+	w.spool = spool
+	return nil
+}
+
+// Truncate changes the size of the file, and leaves where Write writes as is
+func (w *writeFile) Truncate(size int64) error {
+	w.locker.Lock()
+	defer w.locker.Unlock()
+
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: w.Name(), Err: fs.ErrInvalid}
+	}
+
+	if w.spool != nil {
+		err := w.spool.Truncate(size)
+		if err != nil {
+			return err
+		}
+		w.size = size
+		return nil
+	}
+
+	if w.stream != nil {
+		err := w.stream.Close()
+		w.stream = nil
+		if err != nil {
+			return err
+		}
+	}
+
+	err := truncate(w.File, size)
+	if err != nil {
+		return err
+	}
+	w.size = size
+
+	return nil
+}
+
+func (w *writeFile) Close() error {
+	w.locker.Lock()
+	defer w.locker.Unlock()
+
+	if w.stream != nil {
+		err := w.stream.Close()
+		w.stream = nil
+		return errors.Join(err, w.File.Close())
+	}
+
+	if w.spool == nil {
+		return w.File.Close()
+	}
+
+	defer discard(w.spool)
+
+	return errors.Join(upload(w.File, w.spool), w.File.Close())
+}
+
+// Abort closes file without finishing its upload, if it was opened by OpenFile for writing:
+// the request streaming it to dufs is cut off with cause, so it fails instead of leaving a file which looks complete,
+// a spilled file is not uploaded, and a file created by OpenFile is removed. Any other file is closed.
+func Abort(file File, cause error) error {
+	if w, ok := file.(*writeFile); ok {
+		return w.abort(cause)
+	}
+	return file.Close()
+}
+
+func (w *writeFile) abort(cause error) error {
+	w.locker.Lock()
+	defer w.locker.Unlock()
+
+	if w.stream != nil {
+		w.stream.abort(cause)
+		w.stream = nil
+	}
+
+	if w.spool != nil {
+		discard(w.spool)
+		w.spool = nil
+	}
+
+	err := w.File.Close()
+	if w.remove != nil {
+		err = errors.Join(err, w.remove())
+	}
+
+	return err
+}
+
+// download copies the first n bytes of file to a temporary file
+func download(file File, n int64) (*os.File, error) {
+	spool, err := os.CreateTemp("", "dubroker-upload-*")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.CopyN(spool, file, n)
+	}
+	if err != nil {
+		discard(spool)
+		return nil, err
+	}
+
+	return spool, nil
+}
+
+// upload replaces file with the temporary file spool
+func upload(file File, spool *os.File) error {
+	_, err := spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = file.ReadFrom(spool)
+	return err
+}
+
+// discard closes and removes the temporary file spool
+func discard(spool *os.File) {
+	_ = spool.Close()
+	_ = os.Remove(spool.Name())
+}
+
+// stream feeds what is written to it into a request of upload, through a pipe
+type stream struct {
+	writer *io.PipeWriter
+	end    int64 // the offset in the file of the next write
+	done   chan struct{}
+	err    error // of the request, once done is closed
+}
+
+func newStream(off int64, upload func(r io.Reader) (int64, error)) *stream {
+	reader, writer := io.Pipe()
+
+	s := &stream{
+		writer: writer,
+		end:    off,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(s.done)
+		_, s.err = upload(reader)
+		if s.err != nil {
+			_ = reader.CloseWithError(s.err)
+		} else {
+			_ = reader.CloseWithError(errors.New("upload ended early"))
+		}
+	}()
+
+	return s
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	n, err := s.writer.Write(p)
+	s.end += int64(n)
+	if err != nil {
+		<-s.done
+	}
+	return n, err
+}
+
+// Close ends the request, and returns its error
+func (s *stream) Close() error {
+	_ = s.writer.Close()
+	<-s.done
+	return s.err
+}
+
+// abort fails the request with cause, and waits for it to end
+func (s *stream) abort(cause error) {
+	_ = s.writer.CloseWithError(cause)
+	<-s.done
+}
+
+// patchUnsupported reports whether err is the status of a dufs server without PATCH
+func patchUnsupported(err error) bool {
+	var status *HTTPStatusError
+	return errors.As(err, &status) && (status.Code == http.StatusMethodNotAllowed || status.Code == http.StatusNotImplemented)
+}
@@ -0,0 +1,108 @@
+package vfs
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	type write struct {
+		data string
+		off  int64
+	}
+
+	cases := []struct {
+		name    string
+		initial string
+		writes  []write
+		content string
+		puts    int
+	}{
+		{"stream", "", []write{{"abc", 0}, {"def", 3}}, "abcdef", 1},
+		{"patch", "ab", []write{{"c", 2}, {"d", 3}}, "abcd", 0},
+		{"gap", "", []write{{"abc", 0}, {"ghi", 6}, {"def", 3}}, "abcdefghi", 2},
+		{"overwrite", "", []write{{"abc", 0}, {"def", 3}, {"X", 1}}, "aXcdef", 1},
+		{"resume", "hellXX", []write{{"o wo", 4}, {"rld", 8}}, "hello world", 0},
+	}
+
+	for _, c := range cases {
+		m := &memFS{
+			files: map[string][]byte{
+				"/a": []byte(c.initial),
+			},
+		}
+		file, _ := m.Open("/a")
+
+		w := &writeFile{
+			File: file,
+			size: int64(len(c.initial)),
+		}
+
+		for _, wr := range c.writes {
+			_, err := w.WriteAt([]byte(wr.data), wr.off)
+			if err != nil {
+				t.Errorf("%s: Unexpected error: %v", c.name, err)
+			}
+		}
+
+		err := w.Close()
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %v", c.name, err)
+		}
+
+		if string(m.files["/a"]) != c.content {
+			t.Errorf("%s: Expected %q but got %q", c.name, c.content, m.files["/a"])
+		}
+		if m.puts != c.puts {
+			t.Errorf("%s: Expected %d PUT(s) but got %d", c.name, c.puts, m.puts)
+		}
+	}
+}
+
+func TestAbort(t *testing.T) {
+	type write struct {
+		data string
+		off  int64
+	}
+
+	cases := []struct {
+		name    string
+		initial string
+		writes  []write
+		content string // only what was uploaded before the upload was aborted
+	}{
+		{"stream", "", []write{{"abc", 0}, {"def", 3}}, ""},
+		{"patch", "ab", []write{{"c", 2}, {"d", 3}}, "abc"}, // the first PATCH is sent on its own
+		{"spilled", "", []write{{"abc", 0}, {"ghi", 6}}, "abc"},
+	}
+
+	for _, c := range cases {
+		m := &memFS{
+			files: map[string][]byte{
+				"/a": []byte(c.initial),
+			},
+		}
+		file, _ := m.Open("/a")
+
+		w := &writeFile{
+			File: file,
+			size: int64(len(c.initial)),
+		}
+
+		for _, wr := range c.writes {
+			_, err := w.WriteAt([]byte(wr.data), wr.off)
+			if err != nil {
+				t.Errorf("%s: Unexpected error: %v", c.name, err)
+			}
+		}
+
+		err := Abort(w, errors.New("incomplete upload"))
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %v", c.name, err)
+		}
+
+		if string(m.files["/a"]) != c.content {
+			t.Errorf("%s: Expected %q but got %q", c.name, c.content, m.files["/a"])
+		}
+	}
+}
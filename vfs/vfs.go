@@ -0,0 +1,41 @@
+package vfs
+
+import (
+	"github.com/allape/dufs-broker/logging"
+	"io"
+	"io/fs"
+	"time"
+)
+
+var l = logging.New("vfs")
+
+// FS is the filesystem the protocol adapters work on, it is DufsVFS itself or a wrapper around it
+type FS interface {
+	Open(name string) (File, error)
+	Stat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.FileInfo, error)
+	Mkdir(name string, perm fs.FileMode) error
+	Remove(name string) error
+	Rename(oldname, newname string) error
+	// Chtimes sets the modification time of name
+	Chtimes(name string, mtime time.Time) error
+}
+
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.ReaderFrom
+	io.Seeker
+	io.Closer
+
+	// ReadFromAt writes r into the file from off, which is at most its size
+	ReadFromAt(r io.Reader, off int64) (int64, error)
+
+	Name() string
+	Stat() (fs.FileInfo, error)
+	// CachedStat is Stat, but reuses the result of the last call if any
+	CachedStat() (fs.FileInfo, error)
+	ReadDir(n int) ([]fs.FileInfo, error)
+}
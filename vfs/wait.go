@@ -0,0 +1,76 @@
+package vfs
+
+import (
+	"io/fs"
+	"time"
+)
+
+// Waiting calls wait before every operation of fsys, which fails with the error of wait if any.
+// wait usually blocks while the dufs server is offline, so the operation is tried once it is back.
+func Waiting(fsys FS, wait func() error) FS {
+	return &Waited{
+		fs:   fsys,
+		wait: wait,
+	}
+}
+
+type Waited struct {
+	fs   FS
+	wait func() error
+}
+
+func (w *Waited) Open(name string) (File, error) {
+	err := w.wait()
+	if err != nil {
+		return nil, err
+	}
+	return w.fs.Open(name)
+}
+
+func (w *Waited) Stat(name string) (fs.FileInfo, error) {
+	err := w.wait()
+	if err != nil {
+		return nil, err
+	}
+	return w.fs.Stat(name)
+}
+
+func (w *Waited) ReadDir(name string) ([]fs.FileInfo, error) {
+	err := w.wait()
+	if err != nil {
+		return nil, err
+	}
+	return w.fs.ReadDir(name)
+}
+
+func (w *Waited) Mkdir(name string, perm fs.FileMode) error {
+	err := w.wait()
+	if err != nil {
+		return err
+	}
+	return w.fs.Mkdir(name, perm)
+}
+
+func (w *Waited) Remove(name string) error {
+	err := w.wait()
+	if err != nil {
+		return err
+	}
+	return w.fs.Remove(name)
+}
+
+func (w *Waited) Rename(oldname, newname string) error {
+	err := w.wait()
+	if err != nil {
+		return err
+	}
+	return w.fs.Rename(oldname, newname)
+}
+
+func (w *Waited) Chtimes(name string, mtime time.Time) error {
+	err := w.wait()
+	if err != nil {
+		return err
+	}
+	return w.fs.Chtimes(name, mtime)
+}